@@ -16,6 +16,7 @@ import (
 	"repoxy/internal/auth"
 	"repoxy/internal/cache"
 	"repoxy/internal/config"
+	"repoxy/internal/health"
 	"repoxy/internal/janitor"
 	"repoxy/internal/proxy"
 	"repoxy/internal/storage"
@@ -54,6 +55,9 @@ func main() {
 		log.Fatalf("Failed to initialize index: %v", err)
 	}
 
+	// Identical bodies share one blob, reference-counted in the index
+	store.SetBlobRefs(index)
+
 	// Check if index is empty and rebuild if needed
 	count, err := index.Count()
 	if err != nil {
@@ -71,31 +75,26 @@ func main() {
 	jan := janitor.New(store, index, cfg.Cache.MaxSizeBytes, 5*time.Minute)
 	jan.Start()
 
-	// Initialize handlers
-	proxyHandler := proxy.New(cfg, store, index)
-	adminHandler := admin.New(cfg, store, index)
+	// Initialize upstream health tracking
+	tracker := health.NewTracker(cfg)
 
-	// Setup router
-	r := chi.NewRouter()
+	// Initialize handlers
+	proxyHandler := proxy.New(cfg, store, index, tracker)
+	adminHandler := admin.New(cfg, store, index, tracker)
 
-	// Middleware
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(10 * time.Minute))
+	// Start active health probes
+	tracker.StartProbes(proxyHandler.Client())
 
-	// Authentication middleware (if enabled)
+	// Setup router
+	r := newRouter(cfg, false)
 	if cfg.Auth.Enabled {
-		r.Use(func(next http.Handler) http.Handler {
-			return auth.Middleware(&cfg.Auth, next)
-		})
 		log.Printf("Ingress authentication enabled: %s", cfg.Auth.Type)
 	}
 
 	// Admin endpoints
 	r.Get("/_healthz", adminHandler.Health)
 	r.Get("/_stats", adminHandler.Stats)
+	r.Get("/_upstreams", adminHandler.Upstreams)
 	r.Handle("/_metrics", promhttp.Handler())
 
 	if cfg.Admin.EnablePurgeAPI {
@@ -106,12 +105,22 @@ func main() {
 	// Proxy handler (catch-all)
 	r.HandleFunc("/*", proxyHandler.ServeHTTP)
 
+	// Forward-proxy listeners only proxy allowlisted absolute-form requests;
+	// admin endpoints are not reachable through them
+	fwd := newRouter(cfg, true)
+	fwd.HandleFunc("/*", proxyHandler.ServeForward)
+
 	// Create servers for each listener
 	var servers []*http.Server
 	for _, listener := range cfg.Server.Listeners {
+		var handler http.Handler = r
+		if listener.Mode == "forward" {
+			handler = fwd
+		}
+
 		srv := &http.Server{
 			Addr:         listener.Addr,
-			Handler:      r,
+			Handler:      handler,
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 10 * time.Minute,
 			IdleTimeout:  120 * time.Second,
@@ -124,7 +133,7 @@ func main() {
 			if l.TLS != nil {
 				tlsInfo = " (TLS)"
 			}
-			log.Printf("Server listening on %s%s", s.Addr, tlsInfo)
+			log.Printf("Server listening on %s%s (%s proxy)", s.Addr, tlsInfo, l.Mode)
 
 			var err error
 			if l.TLS != nil {
@@ -166,6 +175,9 @@ func main() {
 	log.Println("Stopping janitor...")
 	jan.Stop()
 
+	// Stop health probes
+	tracker.Stop()
+
 	// Close index database
 	log.Println("Closing index...")
 	if err := index.Close(); err != nil {
@@ -175,6 +187,31 @@ func main() {
 	log.Println("Server stopped")
 }
 
+// newRouter creates a router with the common middleware chain. Forward-proxy
+// routers authenticate clients with Proxy-Authorization instead.
+func newRouter(cfg *config.Config, forward bool) *chi.Mux {
+	r := chi.NewRouter()
+
+	// Middleware
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.Timeout(10 * time.Minute))
+
+	// Authentication middleware (if enabled)
+	if cfg.Auth.Enabled {
+		r.Use(func(next http.Handler) http.Handler {
+			if forward {
+				return auth.ProxyMiddleware(&cfg.Auth, next)
+			}
+			return auth.Middleware(&cfg.Auth, next)
+		})
+	}
+
+	return r
+}
+
 func init() {
 	// Custom usage message
 	flag.Usage = func() {
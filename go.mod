@@ -1,22 +1,28 @@
 module repoxy
 
-go 1.22
+go 1.22.0
 
 require (
+	github.com/ProtonMail/go-crypto v1.3.0
 	github.com/go-chi/chi/v5 v5.0.11
+	github.com/klauspost/compress v1.18.0
 	github.com/prometheus/client_golang v1.18.0
+	github.com/ulikunitz/xz v0.5.12
 	go.etcd.io/bbolt v1.3.8
-	golang.org/x/net v0.20.0
+	golang.org/x/net v0.21.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/cloudflare/circl v1.6.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.46.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
-	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 	google.golang.org/protobuf v1.32.0 // indirect
 )
@@ -10,6 +10,7 @@ import (
 
 	"repoxy/internal/cache"
 	"repoxy/internal/config"
+	"repoxy/internal/health"
 	"repoxy/internal/storage"
 )
 
@@ -18,14 +19,16 @@ type Handler struct {
 	config *config.Config
 	store  *cache.Store
 	index  *storage.Index
+	health *health.Tracker
 }
 
 // New creates a new admin handler
-func New(cfg *config.Config, store *cache.Store, index *storage.Index) *Handler {
+func New(cfg *config.Config, store *cache.Store, index *storage.Index, tracker *health.Tracker) *Handler {
 	return &Handler{
 		config: cfg,
 		store:  store,
 		index:  index,
+		health: tracker,
 	}
 }
 
@@ -58,6 +61,14 @@ func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Upstreams returns the health and circuit state of every upstream mirror
+func (h *Handler) Upstreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mirrors": h.health.Snapshot(),
+	})
+}
+
 func calculateHitRatio(hits, misses int64) float64 {
 	total := hits + misses
 	if total == 0 {
@@ -110,6 +121,11 @@ func (h *Handler) PurgeByURL(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Negative entries for the URL
+	purged += h.purgeNegative(func(entry *storage.NegativeEntry) bool {
+		return entry.URL == req.URL
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"purged": purged,
@@ -167,12 +183,39 @@ func (h *Handler) PurgeByRegex(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Negative entries matching the regex
+	purged += h.purgeNegative(func(entry *storage.NegativeEntry) bool {
+		return re.MatchString(entry.URL)
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"purged": purged,
 	})
 }
 
+// purgeNegative deletes the negative entries that match and returns how many
+func (h *Handler) purgeNegative(match func(*storage.NegativeEntry) bool) int {
+	entries, err := h.index.ListNegative()
+	if err != nil {
+		log.Printf("admin: failed to list negative entries: %v", err)
+		return 0
+	}
+
+	var purged int
+	for _, entry := range entries {
+		if !match(entry) {
+			continue
+		}
+		if err := h.index.DeleteNegative(entry.Repo, entry.Key); err != nil {
+			log.Printf("admin: failed to delete negative entry %s/%s: %v", entry.Repo, entry.Key, err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
 func (h *Handler) checkAuth(r *http.Request) bool {
 	if !h.config.Admin.EnablePurgeAPI {
 		return false
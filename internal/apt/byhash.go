@@ -0,0 +1,21 @@
+package apt
+
+import (
+	"path"
+	"strings"
+)
+
+// ByHashDigest returns the SHA256 digest a by-hash path names
+// (.../by-hash/SHA256/<digest>), or "" for any other path
+func ByHashDigest(rest string) string {
+	dir, digest := path.Split(rest)
+	if dir != "by-hash/SHA256/" && !strings.HasSuffix(dir, "/by-hash/SHA256/") || len(digest) != 64 {
+		return ""
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ""
+		}
+	}
+	return digest
+}
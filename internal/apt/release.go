@@ -0,0 +1,123 @@
+// Package apt understands the APT repository metadata the cache needs to
+// keep a suite's index files consistent with its Release file
+package apt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// File is an index file listed in a Release file
+type File struct {
+	Size   int64
+	SHA256 string
+}
+
+// Release is a parsed Release or InRelease file
+type Release struct {
+	Suite         string
+	Codename      string
+	Date          string
+	AcquireByHash bool
+	// Files by path relative to the directory of the Release file
+	Files map[string]File
+}
+
+// IsReleaseFile reports whether rest names a Release or InRelease file
+func IsReleaseFile(rest string) bool {
+	name := path.Base(rest)
+	return name == "InRelease" || name == "Release"
+}
+
+// ParseRelease parses a Release file or a clearsigned InRelease file. The
+// signature is not checked. Only SHA256 checksums are used; a Release
+// without them parses with no files.
+func ParseRelease(r io.Reader) (*Release, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	rel := &Release{Files: make(map[string]File)}
+	var field string
+	first, signed, inHeader := true, false, false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Clearsigned: skip the armor headers, stop at the signature and
+		// undo dash-escaping
+		if first {
+			first = false
+			if line == "-----BEGIN PGP SIGNED MESSAGE-----" {
+				signed, inHeader = true, true
+				continue
+			}
+		}
+		if signed {
+			if inHeader {
+				inHeader = line != ""
+				continue
+			}
+			if line == "-----BEGIN PGP SIGNATURE-----" {
+				break
+			}
+			line = strings.TrimPrefix(line, "- ")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// Continuation lines belong to the last field
+		if line[0] == ' ' || line[0] == '\t' {
+			if field == "SHA256" {
+				if err := rel.addFile(line); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid Release line %q", line)
+		}
+		field = name
+		value = strings.TrimSpace(value)
+
+		switch name {
+		case "Suite":
+			rel.Suite = value
+		case "Codename":
+			rel.Codename = value
+		case "Date":
+			rel.Date = value
+		case "Acquire-By-Hash":
+			rel.AcquireByHash = strings.EqualFold(value, "yes")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Release: %w", err)
+	}
+
+	return rel, nil
+}
+
+// addFile parses a " <sha256> <size> <path>" checksum line
+func (rel *Release) addFile(line string) error {
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid SHA256 line %q", line)
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size in SHA256 line %q", line)
+	}
+
+	rel.Files[parts[2]] = File{Size: size, SHA256: strings.ToLower(parts[0])}
+	return nil
+}
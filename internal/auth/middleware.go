@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/subtle"
+	"encoding/base64"
 	"log"
 	"net/http"
 	"strings"
@@ -11,42 +12,63 @@ import (
 
 // Middleware wraps an HTTP handler with authentication
 func Middleware(cfg *config.AuthConfig, next http.Handler) http.Handler {
+	return middleware(cfg, next, false)
+}
+
+// ProxyMiddleware wraps a forward-proxy handler with authentication. Proxy
+// clients send Proxy-Authorization and expect a 407 challenge.
+func ProxyMiddleware(cfg *config.AuthConfig, next http.Handler) http.Handler {
+	return middleware(cfg, next, true)
+}
+
+func middleware(cfg *config.AuthConfig, next http.Handler, forward bool) http.Handler {
 	if !cfg.Enabled {
 		return next
 	}
 
+	header, challenge, status := "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+	if forward {
+		header, challenge, status = "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip authentication for health/metrics endpoints
-		if r.URL.Path == "/_healthz" || r.URL.Path == "/_metrics" {
+		if !forward && (r.URL.Path == "/_healthz" || r.URL.Path == "/_metrics") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		var authenticated bool
+		credentials := r.Header.Get(header)
 
 		switch strings.ToLower(cfg.Type) {
 		case "basic":
-			authenticated = checkBasicAuth(r, cfg.Users)
+			authenticated = checkBasicAuth(credentials, cfg.Users)
 		case "bearer", "token":
-			authenticated = checkBearerAuth(r, cfg.Tokens)
+			authenticated = checkBearerAuth(credentials, cfg.Tokens)
 		default:
 			log.Printf("Warning: unknown auth type: %s", cfg.Type)
 			authenticated = false
 		}
 
 		if !authenticated {
-			w.Header().Set("WWW-Authenticate", `Basic realm="EdgeCache"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			w.Header().Set(challenge, `Basic realm="EdgeCache"`)
+			http.Error(w, http.StatusText(status), status)
 			return
 		}
 
+		// Proxy credentials are for this hop only
+		if forward {
+			r.Header.Del(header)
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
 // checkBasicAuth validates HTTP Basic Authentication
-func checkBasicAuth(r *http.Request, users map[string]string) bool {
-	username, password, ok := r.BasicAuth()
+func checkBasicAuth(credentials string, users map[string]string) bool {
+	username, password, ok := parseBasicAuth(credentials)
 	if !ok {
 		return false
 	}
@@ -60,9 +82,22 @@ func checkBasicAuth(r *http.Request, users map[string]string) bool {
 	return subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) == 1
 }
 
+// parseBasicAuth parses Basic credentials as http.Request.BasicAuth does,
+// for either Authorization or Proxy-Authorization
+func parseBasicAuth(credentials string) (username, password string, ok bool) {
+	scheme, encoded, ok := strings.Cut(credentials, " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
 // checkBearerAuth validates Bearer token authentication
-func checkBearerAuth(r *http.Request, validTokens []string) bool {
-	authHeader := r.Header.Get("Authorization")
+func checkBearerAuth(authHeader string, validTokens []string) bool {
 	if authHeader == "" {
 		return false
 	}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// casDir holds the content-addressed blobs below the cache dir
+const casDir = "_cas"
+
+// BlobRefs counts the cache entries sharing each content-addressed blob
+type BlobRefs interface {
+	// AddBlobRef records one more entry sharing the blob
+	AddBlobRef(digest string, size int64) error
+	// ReleaseBlobRef drops one reference and returns how many remain
+	ReleaseBlobRef(digest string) (int64, error)
+}
+
+// CASPath returns the path of the content-addressed blob for a SHA256 digest
+func CASPath(cacheDir, digest string) string {
+	return filepath.Join(cacheDir, casDir, "sha256", digest[:2], digest)
+}
+
+// SetBlobRefs enables deduplication: entries with identical bodies are hard
+// links to one content-addressed blob, which is removed with its last
+// reference
+func (s *Store) SetBlobRefs(refs BlobRefs) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+	s.refs = refs
+}
+
+// install moves a finished blob into place, shares it with other entries of
+// the same digest and saves its metadata. The blob it replaces, if any,
+// gives up its reference.
+func (s *Store) install(repo, key, tmpPath string, meta *Metadata) error {
+	blobPath := BlobPath(s.cacheDir, repo, key)
+	metaPath := MetadataPath(s.cacheDir, repo, key)
+
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	replaced := s.sharedDigest(repo, key)
+
+	// Atomically rename to final location
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return fmt.Errorf("failed to rename blob: %w", err)
+	}
+
+	meta.Shared = s.shareBlob(blobPath, meta.SHA256, meta.Size)
+
+	// Save metadata, cleaning up the blob on failure
+	err := SaveMetadata(metaPath, meta)
+	if err != nil {
+		os.Remove(blobPath)
+		if meta.Shared {
+			s.releaseBlob(meta.SHA256)
+		}
+		err = fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	if replaced != "" {
+		s.releaseBlob(replaced)
+	}
+	return err
+}
+
+// sharedDigest returns the digest of an entry whose blob is linked to the
+// content-addressed copy, or "" if it is not shared. Callers hold casMu.
+func (s *Store) sharedDigest(repo, key string) string {
+	if s.refs == nil {
+		return ""
+	}
+
+	meta, err := LoadMetadata(MetadataPath(s.cacheDir, repo, key))
+	if err != nil || meta.SHA256 == "" {
+		return ""
+	}
+
+	blobInfo, err := os.Stat(BlobPath(s.cacheDir, repo, key))
+	if err != nil {
+		return ""
+	}
+	casInfo, err := os.Stat(CASPath(s.cacheDir, meta.SHA256))
+	if err != nil || !os.SameFile(blobInfo, casInfo) {
+		return ""
+	}
+	return meta.SHA256
+}
+
+// shareBlob links an entry blob with the content-addressed copy of its
+// digest: an existing copy replaces the entry's own bytes, otherwise the
+// entry's blob becomes the copy. It reports whether the entry is shared;
+// failures leave it unshared. Callers hold casMu.
+func (s *Store) shareBlob(blobPath, digest string, size int64) bool {
+	if s.refs == nil || digest == "" {
+		return false
+	}
+
+	casPath := CASPath(s.cacheDir, digest)
+	if _, err := os.Stat(casPath); err == nil {
+		tmpPath := blobPath + ".cas"
+		os.Remove(tmpPath)
+		if err := os.Link(casPath, tmpPath); err != nil {
+			log.Printf("cache: failed to link %s: %v", casPath, err)
+			return false
+		}
+		if err := os.Rename(tmpPath, blobPath); err != nil {
+			os.Remove(tmpPath)
+			log.Printf("cache: failed to share %s: %v", casPath, err)
+			return false
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(casPath), 0755); err != nil {
+			log.Printf("cache: failed to create blob dir: %v", err)
+			return false
+		}
+		if err := os.Link(blobPath, casPath); err != nil {
+			log.Printf("cache: failed to link %s: %v", casPath, err)
+			return false
+		}
+	}
+
+	if err := s.refs.AddBlobRef(digest, size); err != nil {
+		log.Printf("cache: failed to reference blob %s: %v", digest, err)
+	}
+	return true
+}
+
+// releaseBlob drops a reference to a content-addressed blob and removes it
+// once no entry uses it. Callers hold casMu.
+func (s *Store) releaseBlob(digest string) {
+	remaining, err := s.refs.ReleaseBlobRef(digest)
+	if err != nil {
+		log.Printf("cache: failed to release blob %s: %v", digest, err)
+		return
+	}
+	if remaining <= 0 {
+		if err := os.Remove(CASPath(s.cacheDir, digest)); err != nil && !os.IsNotExist(err) {
+			log.Printf("cache: failed to remove blob %s: %v", digest, err)
+		}
+	}
+}
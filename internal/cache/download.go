@@ -0,0 +1,489 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrDownloadTimeout is returned when an in-flight download does not produce
+// response headers within the lock timeout
+var ErrDownloadTimeout = errors.New("timed out waiting for in-flight download")
+
+// ErrAbandoned is returned by Write when every reader has gone away and the
+// download is larger than its orphan limit
+var ErrAbandoned = errors.New("download abandoned by all clients")
+
+// ErrChecksumMismatch is returned by Write and Commit when the content does
+// not have the expected size or SHA256 digest
+var ErrChecksumMismatch = errors.New("content does not match expected checksum")
+
+// Checksum is the size and SHA256 digest content is expected to have. A
+// zero Size or empty SHA256 is not checked.
+type Checksum struct {
+	Size   int64
+	SHA256 string
+}
+
+// Verifier checks the complete content of a download before it is
+// committed; an error aborts the download
+type Verifier func(body io.Reader) error
+
+// Download is an upstream transfer being written into the cache. Requests
+// for the same key that arrive while it is in progress read the partially
+// written temp file as it grows instead of waiting for it to finish.
+type Download struct {
+	Repo string
+	Key  string
+
+	store   *Store
+	tmpPath string
+	file    *os.File
+	hash    hash.Hash // SHA256 of the bytes written so far
+	expect  Checksum  // Required size and digest
+	verify  Verifier  // Content check before commit; readers wait for it
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	readyCh chan struct{}
+	meta    *Metadata
+	size    int64 // Expected total size, -1 if unknown until done
+	written int64
+	ready   bool
+	done    bool
+	err     error
+
+	readers     int   // Open DownloadReaders
+	orphanLimit int64 // Max size to keep filling with no readers, -1 for no limit
+}
+
+func newDownload(s *Store, repo, key string) *Download {
+	dl := &Download{
+		Repo:        repo,
+		Key:         key,
+		store:       s,
+		tmpPath:     BlobPath(s.cacheDir, repo, key) + ".download",
+		readyCh:     make(chan struct{}),
+		hash:        sha256.New(),
+		size:        -1,
+		orphanLimit: -1,
+	}
+	dl.cond = sync.NewCond(&dl.mu)
+	return dl
+}
+
+// StartDownload returns the in-flight download for the key, registering a
+// new one if there is none. The caller that registered it (leader == true)
+// must eventually call Begin and then Commit or Abort, or Abort directly.
+func (s *Store) StartDownload(repo, key string) (dl *Download, leader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := repo + "/" + key
+	if dl, ok := s.downloads[id]; ok {
+		return dl, false
+	}
+
+	dl = newDownload(s, repo, key)
+	s.downloads[id] = dl
+	return dl, true
+}
+
+// InFlight returns the in-flight download for the key, or nil if there is
+// none
+func (s *Store) InFlight(repo, key string) *Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads[repo+"/"+key]
+}
+
+// finishDownload unregisters a download once it has been committed or aborted
+func (s *Store) finishDownload(dl *Download) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := dl.Repo + "/" + dl.Key
+	if s.downloads[id] == dl {
+		delete(s.downloads, id)
+	}
+}
+
+// Begin opens the temp file for writing once the upstream response headers
+// are known. size is the expected body length, or -1 if unknown.
+func (dl *Download) Begin(meta *Metadata, size int64) error {
+	keyDir := filepath.Dir(dl.tmpPath)
+	if err := os.MkdirAll(keyDir, 0755); err != nil {
+		err = fmt.Errorf("failed to create key dir: %w", err)
+		dl.Abort(err)
+		return err
+	}
+
+	f, err := os.Create(dl.tmpPath)
+	if err != nil {
+		err = fmt.Errorf("failed to create temp file: %w", err)
+		dl.Abort(err)
+		return err
+	}
+
+	dl.mu.Lock()
+	dl.file = f
+	dl.meta = meta
+	dl.size = size
+	dl.ready = true
+	dl.mu.Unlock()
+
+	close(dl.readyCh)
+	return nil
+}
+
+// SetOrphanLimit sets how large the download may be and still be finished
+// once it has no readers left. 0 aborts as soon as the last reader goes
+// away, -1 (the default) always finishes.
+func (dl *Download) SetOrphanLimit(limit int64) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.orphanLimit = limit
+}
+
+// Expect makes the download fail with ErrChecksumMismatch unless the
+// content has the given size and hex SHA256 digest. Oversized content fails
+// as soon as it is written, the rest on Commit; readers get the last byte
+// only once it has passed.
+func (dl *Download) Expect(sum Checksum) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.expect = sum
+}
+
+// Verify makes Commit run fn over the complete content first. Readers get
+// no bytes until it has passed.
+func (dl *Download) Verify(fn Verifier) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.verify = fn
+}
+
+// Verified blocks until a download with a Verifier is committed or aborted
+// and returns the error it failed with. It returns nil right away for
+// downloads without one.
+func (dl *Download) Verified() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.verify == nil {
+		return nil
+	}
+	for !dl.done {
+		dl.cond.Wait()
+	}
+	return dl.err
+}
+
+// Write appends to the temp file and wakes up readers waiting for the bytes.
+// It fails with ErrAbandoned once the download has no readers and exceeds
+// its orphan limit.
+func (dl *Download) Write(p []byte) (int, error) {
+	n, err := dl.file.Write(p)
+	dl.hash.Write(p[:n])
+
+	dl.mu.Lock()
+	dl.written += int64(n)
+	abandoned := dl.readers == 0 && dl.orphanLimit >= 0 &&
+		(dl.written > dl.orphanLimit || dl.size > dl.orphanLimit)
+	oversized := dl.expect.Size > 0 && dl.written > dl.expect.Size
+	written, want := dl.written, dl.expect.Size
+	dl.mu.Unlock()
+	dl.cond.Broadcast()
+
+	if err != nil {
+		return n, fmt.Errorf("failed to write blob: %w", err)
+	}
+	if oversized {
+		return n, fmt.Errorf("%w: got at least %d bytes, want %d", ErrChecksumMismatch, written, want)
+	}
+	if abandoned {
+		return n, ErrAbandoned
+	}
+	return n, nil
+}
+
+// Commit syncs the temp file, moves it to its final location and saves the
+// metadata. Readers that already opened the temp file keep reading it.
+func (dl *Download) Commit() error {
+	if err := dl.file.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync blob: %w", err)
+		dl.Abort(err)
+		return err
+	}
+	dl.file.Close()
+
+	dl.mu.Lock()
+	verify := dl.verify
+	dl.mu.Unlock()
+	if verify != nil {
+		if err := dl.runVerify(verify); err != nil {
+			dl.Abort(err)
+			return err
+		}
+	}
+
+	dl.mu.Lock()
+	if dl.size >= 0 && dl.written != dl.size {
+		dl.mu.Unlock()
+		err := fmt.Errorf("short body: got %d of %d bytes", dl.written, dl.size)
+		dl.Abort(err)
+		return err
+	}
+
+	if dl.expect.Size > 0 && dl.written != dl.expect.Size {
+		dl.mu.Unlock()
+		err := fmt.Errorf("%w: got %d bytes, want %d", ErrChecksumMismatch, dl.written, dl.expect.Size)
+		dl.Abort(err)
+		return err
+	}
+
+	digest := hex.EncodeToString(dl.hash.Sum(nil))
+	if dl.expect.SHA256 != "" && digest != dl.expect.SHA256 {
+		dl.mu.Unlock()
+		err := fmt.Errorf("%w: got sha256 %s, want %s", ErrChecksumMismatch, digest, dl.expect.SHA256)
+		dl.Abort(err)
+		return err
+	}
+
+	// Update metadata with actual size and digest
+	dl.meta.Size = dl.written
+	dl.meta.SHA256 = digest
+	dl.size = dl.written
+
+	// Move the blob into place and share it with identical ones
+	if err := dl.store.install(dl.Repo, dl.Key, dl.tmpPath, dl.meta); err != nil {
+		dl.mu.Unlock()
+		dl.Abort(err)
+		return err
+	}
+
+	dl.done = true
+	dl.mu.Unlock()
+	dl.cond.Broadcast()
+
+	dl.store.finishDownload(dl)
+	return nil
+}
+
+// runVerify runs a Verifier over the finished temp file
+func (dl *Download) runVerify(verify Verifier) error {
+	f, err := os.Open(dl.tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
+	return verify(f)
+}
+
+// Abort fails the download, removes the temp file and wakes up all readers
+// with the error. It is safe to call more than once and before Begin.
+func (dl *Download) Abort(err error) {
+	dl.mu.Lock()
+	if dl.done {
+		dl.mu.Unlock()
+		return
+	}
+	dl.done = true
+	dl.err = err
+	wasReady := dl.ready
+	if dl.file != nil {
+		dl.file.Close()
+		os.Remove(dl.tmpPath)
+	}
+	dl.mu.Unlock()
+
+	if !wasReady {
+		close(dl.readyCh)
+	}
+	dl.cond.Broadcast()
+
+	dl.store.finishDownload(dl)
+}
+
+// Wait blocks until the leader has received response headers and started
+// writing, the download fails, or the timeout elapses
+func (dl *Download) Wait(timeout time.Duration, cancel <-chan struct{}) (*Metadata, error) {
+	select {
+	case <-dl.readyCh:
+	case <-time.After(timeout):
+		return nil, ErrDownloadTimeout
+	case <-cancel:
+		return nil, ErrDownloadTimeout
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if !dl.ready {
+		return nil, dl.err
+	}
+	return dl.meta, nil
+}
+
+// Meta returns a copy of the metadata without blocking, or nil if the
+// download has not started writing yet or failed
+func (dl *Download) Meta() *Metadata {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if !dl.ready || dl.err != nil {
+		return nil
+	}
+	meta := *dl.meta
+	return &meta
+}
+
+// Written returns the number of bytes written so far
+func (dl *Download) Written() int64 {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.written
+}
+
+// ExpectedSize returns the expected total size without blocking, or -1 if
+// it is not known yet
+func (dl *Download) ExpectedSize() int64 {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.size
+}
+
+// Size returns the expected total size, blocking until the download is
+// done if upstream did not send a Content-Length
+func (dl *Download) Size() (int64, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	for dl.size < 0 && !dl.done {
+		dl.cond.Wait()
+	}
+	if dl.err != nil {
+		return 0, dl.err
+	}
+	return dl.size, nil
+}
+
+// waitFor blocks until more than off bytes can be read or the download is
+// done, and returns the number of bytes that can be read so far. Downloads
+// with a Verifier are only read once done.
+func (dl *Download) waitFor(off int64) (int64, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	for (dl.readable() <= off || dl.verify != nil) && !dl.done {
+		dl.cond.Wait()
+	}
+	if dl.err != nil {
+		return 0, dl.err
+	}
+	return dl.readable(), nil
+}
+
+// readable returns how many bytes readers may have. A download with an
+// expected checksum holds back its last byte until it is committed, so no
+// reader ever gets the complete content unless it matched.
+func (dl *Download) readable() int64 {
+	if dl.expect != (Checksum{}) && !dl.done && dl.written > 0 {
+		return dl.written - 1
+	}
+	return dl.written
+}
+
+// NewReader returns a reader over the download that blocks until bytes are
+// on disk. Must be called after Wait succeeded.
+func (dl *Download) NewReader() (*DownloadReader, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.err != nil {
+		return nil, dl.err
+	}
+
+	// Once committed the temp file has been renamed to the blob
+	path := dl.tmpPath
+	if dl.done {
+		path = BlobPath(dl.store.cacheDir, dl.Repo, dl.Key)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dl.readers++
+	return &DownloadReader{dl: dl, f: f}, nil
+}
+
+// DownloadReader reads a Download while it is being written
+type DownloadReader struct {
+	dl  *Download
+	f   *os.File
+	off int64
+}
+
+// Read reads from the current offset, waiting for the writer if needed
+func (r *DownloadReader) Read(p []byte) (int, error) {
+	written, err := r.dl.waitFor(r.off)
+	if err != nil {
+		return 0, err
+	}
+	if written <= r.off {
+		return 0, io.EOF
+	}
+
+	if avail := written - r.off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+
+	n, err := r.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read. Seeking relative to the end
+// waits until the total size is known.
+func (r *DownloadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		size, err := r.dl.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Close closes the underlying file and releases the reader from the download
+func (r *DownloadReader) Close() error {
+	r.dl.mu.Lock()
+	r.dl.readers--
+	r.dl.mu.Unlock()
+
+	return r.f.Close()
+}
@@ -21,6 +21,19 @@ type Metadata struct {
 	LastAccess   time.Time `json:"last_access"`
 	Hits         int64     `json:"hits"`
 	ContentType  string    `json:"content_type,omitempty"`
+	SHA256       string    `json:"sha256,omitempty"` // Digest of the stored blob
+	Shared       bool      `json:"shared,omitempty"` // Blob is linked to the content-addressed copy
+
+	// Representation headers replayed on hits
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Vary            string `json:"vary,omitempty"`
+
+	// ExpiresAt is the computed end of the freshness lifetime; entries
+	// written before it existed fall back to CreatedAt plus the policy TTL
+	ExpiresAt time.Time `json:"expires_at"`
+	// MustRevalidate forbids serving the entry once stale (Cache-Control:
+	// must-revalidate, proxy-revalidate or no-cache)
+	MustRevalidate bool `json:"must_revalidate,omitempty"`
 }
 
 // CacheKey generates a SHA256 hash for the cache key
@@ -29,6 +42,27 @@ func CacheKey(url string) string {
 	return hex.EncodeToString(h[:])
 }
 
+// VariantKey generates the cache key for one content-coding variant of a
+// URL. The identity variant uses the plain URL key.
+func VariantKey(url, encoding string) string {
+	if encoding == "" || encoding == "identity" {
+		return CacheKey(url)
+	}
+	return CacheKey(url + "#encoding=" + encoding)
+}
+
+// DigestKey generates the cache key of a content-addressed object, stored
+// once under its SHA256 digest whatever URL it was requested by
+func DigestKey(sha256 string) string {
+	return CacheKey("sha256:" + sha256)
+}
+
+// ContentAddressed reports whether the entry is stored under the digest of
+// its own content; such entries can never change
+func (m *Metadata) ContentAddressed(key string) bool {
+	return m.SHA256 != "" && key == DigestKey(m.SHA256)
+}
+
 // BlobPath returns the path to the cached blob
 func BlobPath(cacheDir, repo, key string) string {
 	return filepath.Join(cacheDir, repo, key, "blob")
@@ -104,9 +138,28 @@ func CreateSymlink(cacheDir, repo, rest, key string) error {
 	return nil
 }
 
-// IsStale checks if cached content is stale based on TTL
+// Expiry returns when the entry stops being fresh, using ExpiresAt if it was
+// computed and CreatedAt plus ttl otherwise
+func (m *Metadata) Expiry(ttl time.Duration) time.Time {
+	if !m.ExpiresAt.IsZero() {
+		return m.ExpiresAt
+	}
+	return m.CreatedAt.Add(ttl)
+}
+
+// IsStale checks if cached content is past its expiry
 func (m *Metadata) IsStale(ttl time.Duration) bool {
-	return time.Since(m.CreatedAt) > ttl
+	return time.Now().After(m.Expiry(ttl))
+}
+
+// CanServeStale checks if stale content is still within the stale-if-error
+// window, i.e. no more than window past its expiry, and upstream did not
+// forbid serving it stale
+func (m *Metadata) CanServeStale(ttl, window time.Duration) bool {
+	if m.MustRevalidate {
+		return false
+	}
+	return !time.Now().After(m.Expiry(ttl).Add(window))
 }
 
 // UpdateAccess updates access time and hit counter
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -13,6 +12,12 @@ import (
 type Store struct {
 	cacheDir string
 	locks    *LockManager
+
+	mu        sync.Mutex
+	downloads map[string]*Download // In-flight downloads by repo/key
+
+	casMu sync.Mutex // Serializes changes to shared blobs and their references
+	refs  BlobRefs   // nil disables deduplication
 }
 
 // NewStore creates a new cache store
@@ -22,8 +27,9 @@ func NewStore(cacheDir string, lockTimeout time.Duration) (*Store, error) {
 	}
 
 	return &Store{
-		cacheDir: cacheDir,
-		locks:    NewLockManager(lockTimeout),
+		cacheDir:  cacheDir,
+		locks:     NewLockManager(lockTimeout),
+		downloads: make(map[string]*Download),
 	}, nil
 }
 
@@ -47,54 +53,32 @@ func (s *Store) Get(repo, key string) (*os.File, *Metadata, error) {
 	return f, meta, nil
 }
 
-// Put stores a new cached object with metadata
-func (s *Store) Put(repo, key string, reader io.Reader, meta *Metadata) error {
-	blobPath := BlobPath(s.cacheDir, repo, key)
-	metaPath := MetadataPath(s.cacheDir, repo, key)
-
-	// Create key directory (contains blob and meta.json)
-	keyDir := filepath.Join(s.cacheDir, repo, key)
-	if err := os.MkdirAll(keyDir, 0755); err != nil {
-		return fmt.Errorf("failed to create key dir: %w", err)
-	}
-
-	// Write blob to temporary file
-	tmpPath := blobPath + ".tmp"
-	f, err := os.Create(tmpPath)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer f.Close()
-
-	written, err := io.Copy(f, reader)
-	if err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to write blob: %w", err)
-	}
-
-	if err := f.Sync(); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to sync blob: %w", err)
-	}
-	f.Close()
-
-	// Update metadata with actual size
-	meta.Size = written
+// GetMetadata retrieves only the metadata of a cached object
+func (s *Store) GetMetadata(repo, key string) (*Metadata, error) {
+	return LoadMetadata(MetadataPath(s.cacheDir, repo, key))
+}
 
-	// Atomically rename to final location
-	if err := os.Rename(tmpPath, blobPath); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("failed to rename blob: %w", err)
+// Put stores a new cached object with metadata, failing with
+// ErrChecksumMismatch unless it matches expect and with the error of verify,
+// if given, unless that accepts it
+func (s *Store) Put(repo, key string, reader io.Reader, meta *Metadata, expect Checksum, verify Verifier) error {
+	// Not registered as in-flight: Put replaces existing entries, which
+	// readers already get from the previous blob
+	dl := newDownload(s, repo, key)
+	dl.tmpPath = BlobPath(s.cacheDir, repo, key) + ".tmp"
+
+	dl.Expect(expect)
+	dl.Verify(verify)
+	if err := dl.Begin(meta, -1); err != nil {
+		return err
 	}
 
-	// Save metadata
-	if err := SaveMetadata(metaPath, meta); err != nil {
-		// Clean up blob on metadata save failure
-		os.Remove(blobPath)
-		return fmt.Errorf("failed to save metadata: %w", err)
+	if _, err := io.Copy(dl, reader); err != nil {
+		dl.Abort(err)
+		return err
 	}
 
-	return nil
+	return dl.Commit()
 }
 
 // UpdateMetadata updates just the metadata file
@@ -114,11 +98,19 @@ func (s *Store) Exists(repo, key string) bool {
 	return err1 == nil && err2 == nil
 }
 
-// Delete removes a cache entry
+// Delete removes a cache entry. A shared blob is only removed from disk
+// with its last reference.
 func (s *Store) Delete(repo, key string) error {
 	blobPath := BlobPath(s.cacheDir, repo, key)
 	metaPath := MetadataPath(s.cacheDir, repo, key)
 
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	if digest := s.sharedDigest(repo, key); digest != "" {
+		defer s.releaseBlob(digest)
+	}
+
 	var firstErr error
 
 	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
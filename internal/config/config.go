@@ -2,11 +2,14 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
+	"repoxy/internal/signature"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -19,6 +22,15 @@ type Config struct {
 	Logging   LoggingConfig             `yaml:"logging"`
 	Proxy     ProxyConfig               `yaml:"proxy,omitempty"` // Egress proxy for upstream connections
 	Auth      AuthConfig                `yaml:"auth,omitempty"`  // Ingress authentication
+
+	ForwardProxy ForwardProxyConfig `yaml:"forward_proxy,omitempty"` // Hosts reachable through forward listeners
+	Dynamic      DynamicConfig      `yaml:"dynamic_upstreams,omitempty"`
+
+	// Compiled upstream routes in match order, and preset policies and
+	// preset catch-all policies by upstream name (set during validation)
+	routes    []route
+	presets   map[string][]PolicyConfig
+	fallbacks map[string]*PolicyConfig
 }
 
 type ServerConfig struct {
@@ -28,6 +40,7 @@ type ServerConfig struct {
 type ListenerConfig struct {
 	Addr string     `yaml:"addr"`
 	TLS  *TLSConfig `yaml:"tls,omitempty"`
+	Mode string     `yaml:"mode,omitempty"` // "reverse" (default) or "forward" for Acquire::http::Proxy-style clients
 }
 
 type TLSConfig struct {
@@ -42,6 +55,13 @@ type CacheConfig struct {
 	RevalidateETag    bool          `yaml:"revalidate_etag"`
 	RevalidateLastMod bool          `yaml:"revalidate_last_modified"`
 	LockTimeout       time.Duration `yaml:"lock_timeout"`
+	ResumeRetries     int           `yaml:"resume_retries"`    // Range retries after an upstream transfer drops mid-body
+	FillIdleTimeout   time.Duration `yaml:"fill_idle_timeout"` // Max time a fill may receive no bytes before it is resumed
+
+	// How Accept-Encoding is handled: "vary" (default) keys entries by the
+	// negotiated encoding, "identity" always fetches uncompressed bodies and
+	// gzips compressible types on the fly for clients that accept it
+	Encoding string `yaml:"encoding"`
 }
 
 type PolicyConfig struct {
@@ -49,15 +69,94 @@ type PolicyConfig struct {
 	Regex                     string        `yaml:"regex"`
 	CacheTTL                  time.Duration `yaml:"cache_ttl"`
 	AllowStaleWhileRevalidate bool          `yaml:"allow_stale_while_revalidate"`
+	StaleIfError              time.Duration `yaml:"stale_if_error"` // Serve stale copies this long past TTL when upstream fails
+
+	// What to do with a download once every client reading it has gone:
+	// "always" (default) finishes it into the cache, "never" aborts it,
+	// "limit" finishes it only if the object is at most CompleteOnDisconnectMaxSize
+	CompleteOnDisconnect        string `yaml:"complete_on_disconnect"`
+	CompleteOnDisconnectMaxSize int64  `yaml:"complete_on_disconnect_max_size"`
+
+	// How to answer a Range request for an object that is not cached:
+	// "fill" (default) downloads the whole object and serves the range as
+	// soon as its bytes are on disk, "proxy" forwards the range upstream
+	// right away while the whole object fills in the background
+	RangeOnMiss string `yaml:"range_on_miss"`
+
+	// Fill the cache on a HEAD miss instead of forwarding the HEAD upstream
+	FillOnHead bool `yaml:"fill_on_head"`
+
+	// Where freshness comes from: "policy" (default) always uses CacheTTL,
+	// "upstream" uses Cache-Control/Expires when present and CacheTTL
+	// otherwise, "clamp" does the same but bounds the result to MinTTL..MaxTTL
+	Freshness string        `yaml:"freshness"`
+	MinTTL    time.Duration `yaml:"min_ttl"`
+	MaxTTL    time.Duration `yaml:"max_ttl"`
+
+	// Remember error responses with these statuses for NegativeTTL so
+	// repeated probes for missing files do not reach upstream (0 disables)
+	NegativeTTL      time.Duration `yaml:"negative_ttl"`
+	NegativeStatuses []int         `yaml:"negative_statuses"`
+
+	// Scope: the policy only applies to these upstreams (names or globs such
+	// as "https-*"), methods, query-string presence ("any", "none",
+	// "present") and response Content-Type prefixes. Empty matches all.
+	Upstreams    []string `yaml:"upstreams,omitempty"`
+	Methods      []string `yaml:"methods,omitempty"`
+	Query        string   `yaml:"query,omitempty"`
+	ContentTypes []string `yaml:"content_types,omitempty"`
+
+	// Action: "cache" (default), "no-store" serves existing entries but never
+	// stores new ones, "bypass" skips the cache entirely
+	Action string `yaml:"action,omitempty"`
+	// Only store objects within these sizes (by Content-Length; 0 = no limit).
+	// With a max size, responses without Content-Length are not stored.
+	MinObjectSize int64 `yaml:"min_object_size,omitempty"`
+	MaxObjectSize int64 `yaml:"max_object_size,omitempty"`
 
 	// Compiled regex (set during validation)
 	CompiledRegex *regexp.Regexp `yaml:"-"`
 }
 
 type UpstreamConfig struct {
+	Type       string            `yaml:"type,omitempty"` // Repository format preset: apt, rpm, apk, pacman or zypper
 	BaseURL    string            `yaml:"base_url"`
+	Mirrors    []string          `yaml:"mirrors,omitempty"` // Fallback mirrors, tried in order after base_url
 	PathPrefix string            `yaml:"path_prefix"`
-	Headers    map[string]string `yaml:"headers,omitempty"` // Custom headers (e.g., Authorization)
+	Hosts      []string          `yaml:"hosts,omitempty"`    // Only match requests for these Host headers ("*.example.com" allowed)
+	Priority   int               `yaml:"priority,omitempty"` // Higher wins when several upstreams match
+	Headers    map[string]string `yaml:"headers,omitempty"`  // Custom headers (e.g., Authorization)
+	Health     HealthConfig      `yaml:"health,omitempty"`
+
+	// OpenPGP (or, for apk, PEM RSA) public key files; when set, signed
+	// metadata of a typed upstream is only cached once it verifies
+	TrustedKeys []string `yaml:"trusted_keys,omitempty"`
+
+	// Metalink document of an rpm or zypper repository (base_url is its
+	// root): the mirrors it lists are tried first and its hashes verify
+	// repodata/repomd.xml
+	Metalink string `yaml:"metalink,omitempty"`
+
+	Redirects RedirectConfig `yaml:"redirects,omitempty"`
+
+	// Loaded trusted keys (set during validation)
+	Keyring *signature.Keyring `yaml:"-"`
+}
+
+// HealthConfig configures per-upstream health tracking and the circuit breaker
+type HealthConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"` // Consecutive failures before a mirror's circuit opens
+	OpenTimeout      time.Duration `yaml:"open_timeout"`      // How long a circuit stays open before a trial request
+	ProbePath        string        `yaml:"probe_path"`        // Optional path for active probes (e.g., "dists/jammy/Release")
+	ProbeInterval    time.Duration `yaml:"probe_interval"`
+	ProbeTimeout     time.Duration `yaml:"probe_timeout"`
+}
+
+// RedirectConfig configures how redirects from an upstream are handled
+type RedirectConfig struct {
+	Mode         string        `yaml:"mode"`          // "pass" hands them to the client, "follow" fetches and caches the target (default for rpm and zypper)
+	AllowedHosts []string      `yaml:"allowed_hosts"` // Other hosts that may be followed to ("*.example.com" allowed, "*" for any)
+	CacheTTL     time.Duration `yaml:"cache_ttl"`     // How long a followed redirect is remembered and its target fetched directly; 0 disables
 }
 
 type AdminConfig struct {
@@ -79,6 +178,39 @@ type ProxyConfig struct {
 	Password string `yaml:"password"` // Optional
 }
 
+// ForwardProxyConfig lists the hosts forward-proxy clients may request and
+// the upstreams they map to
+type ForwardProxyConfig struct {
+	AllowedHosts []ForwardHostConfig `yaml:"allowed_hosts"`
+}
+
+// ForwardHostConfig allows a target host ("*.archive.ubuntu.com" wildcards
+// allowed). Without Upstream, the upstream whose base_url or mirrors use the
+// same host is picked.
+type ForwardHostConfig struct {
+	Host     string `yaml:"host"`
+	Upstream string `yaml:"upstream,omitempty"`
+}
+
+// DynamicConfig configures upstreams built from the request path,
+// apt-cacher-ng style: /HTTPS///download.docker.com/linux/ubuntu/... is
+// fetched from https://download.docker.com/linux/ubuntu/...
+type DynamicConfig struct {
+	Enabled    bool                 `yaml:"enabled"`
+	PathPrefix string               `yaml:"path_prefix"` // Default "/HTTPS///"
+	Allow      []DynamicAllowConfig `yaml:"allow"`
+}
+
+// DynamicAllowConfig allows a host ("*.example.com" wildcards allowed) and
+// optionally restricts the paths on it
+type DynamicAllowConfig struct {
+	Host  string   `yaml:"host"`
+	Paths []string `yaml:"paths,omitempty"` // Regexes matched against the path on the host; empty allows all
+
+	// Compiled path regexes (set during validation)
+	CompiledPaths []*regexp.Regexp `yaml:"-"`
+}
+
 // AuthConfig configures ingress authentication for client requests
 type AuthConfig struct {
 	Enabled bool   `yaml:"enabled"`
@@ -105,13 +237,19 @@ func (c *CacheConfig) UnmarshalYAML(node *yaml.Node) error {
 		RevalidateETag    bool   `yaml:"revalidate_etag"`
 		RevalidateLastMod bool   `yaml:"revalidate_last_modified"`
 		LockTimeout       string `yaml:"lock_timeout"`
+		ResumeRetries     int    `yaml:"resume_retries"`
+		FillIdleTimeout   string `yaml:"fill_idle_timeout"`
+		Encoding          string `yaml:"encoding"`
 	}
+	temp.ResumeRetries = 3
 
 	if err := node.Decode(&temp); err != nil {
 		return err
 	}
 
 	raw.Dir = temp.Dir
+	raw.ResumeRetries = temp.ResumeRetries
+	raw.Encoding = temp.Encoding
 	raw.RevalidateETag = temp.RevalidateETag
 	raw.RevalidateLastMod = temp.RevalidateLastMod
 
@@ -140,6 +278,14 @@ func (c *CacheConfig) UnmarshalYAML(node *yaml.Node) error {
 		raw.LockTimeout = dur
 	}
 
+	if temp.FillIdleTimeout != "" {
+		dur, err := parseDuration(temp.FillIdleTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid fill_idle_timeout: %w", err)
+		}
+		raw.FillIdleTimeout = dur
+	}
+
 	*c = CacheConfig(raw)
 	return nil
 }
@@ -149,10 +295,27 @@ func (p *PolicyConfig) UnmarshalYAML(node *yaml.Node) error {
 	raw := rawPolicy{}
 
 	var temp struct {
-		Name                      string `yaml:"name"`
-		Regex                     string `yaml:"regex"`
-		CacheTTL                  string `yaml:"cache_ttl"`
-		AllowStaleWhileRevalidate bool   `yaml:"allow_stale_while_revalidate"`
+		Name                        string   `yaml:"name"`
+		Regex                       string   `yaml:"regex"`
+		CacheTTL                    string   `yaml:"cache_ttl"`
+		AllowStaleWhileRevalidate   bool     `yaml:"allow_stale_while_revalidate"`
+		StaleIfError                string   `yaml:"stale_if_error"`
+		CompleteOnDisconnect        string   `yaml:"complete_on_disconnect"`
+		CompleteOnDisconnectMaxSize string   `yaml:"complete_on_disconnect_max_size"`
+		RangeOnMiss                 string   `yaml:"range_on_miss"`
+		FillOnHead                  bool     `yaml:"fill_on_head"`
+		Freshness                   string   `yaml:"freshness"`
+		MinTTL                      string   `yaml:"min_ttl"`
+		MaxTTL                      string   `yaml:"max_ttl"`
+		NegativeTTL                 string   `yaml:"negative_ttl"`
+		NegativeStatuses            []int    `yaml:"negative_statuses"`
+		Upstreams                   []string `yaml:"upstreams"`
+		Methods                     []string `yaml:"methods"`
+		Query                       string   `yaml:"query"`
+		ContentTypes                []string `yaml:"content_types"`
+		Action                      string   `yaml:"action"`
+		MinObjectSize               string   `yaml:"min_object_size"`
+		MaxObjectSize               string   `yaml:"max_object_size"`
 	}
 
 	if err := node.Decode(&temp); err != nil {
@@ -162,6 +325,16 @@ func (p *PolicyConfig) UnmarshalYAML(node *yaml.Node) error {
 	raw.Name = temp.Name
 	raw.Regex = temp.Regex
 	raw.AllowStaleWhileRevalidate = temp.AllowStaleWhileRevalidate
+	raw.CompleteOnDisconnect = temp.CompleteOnDisconnect
+	raw.RangeOnMiss = temp.RangeOnMiss
+	raw.FillOnHead = temp.FillOnHead
+	raw.Freshness = temp.Freshness
+	raw.NegativeStatuses = temp.NegativeStatuses
+	raw.Upstreams = temp.Upstreams
+	raw.Methods = temp.Methods
+	raw.Query = temp.Query
+	raw.ContentTypes = temp.ContentTypes
+	raw.Action = temp.Action
 
 	if temp.CacheTTL != "" {
 		dur, err := parseDuration(temp.CacheTTL)
@@ -171,10 +344,134 @@ func (p *PolicyConfig) UnmarshalYAML(node *yaml.Node) error {
 		raw.CacheTTL = dur
 	}
 
+	if temp.StaleIfError != "" {
+		dur, err := parseDuration(temp.StaleIfError)
+		if err != nil {
+			return fmt.Errorf("invalid stale_if_error: %w", err)
+		}
+		raw.StaleIfError = dur
+	}
+
+	if temp.MinTTL != "" {
+		dur, err := parseDuration(temp.MinTTL)
+		if err != nil {
+			return fmt.Errorf("invalid min_ttl: %w", err)
+		}
+		raw.MinTTL = dur
+	}
+
+	if temp.MaxTTL != "" {
+		dur, err := parseDuration(temp.MaxTTL)
+		if err != nil {
+			return fmt.Errorf("invalid max_ttl: %w", err)
+		}
+		raw.MaxTTL = dur
+	}
+
+	if temp.NegativeTTL != "" {
+		dur, err := parseDuration(temp.NegativeTTL)
+		if err != nil {
+			return fmt.Errorf("invalid negative_ttl: %w", err)
+		}
+		raw.NegativeTTL = dur
+	}
+
+	if temp.MinObjectSize != "" {
+		size, err := parseSize(temp.MinObjectSize)
+		if err != nil {
+			return fmt.Errorf("invalid min_object_size: %w", err)
+		}
+		raw.MinObjectSize = size
+	}
+
+	if temp.MaxObjectSize != "" {
+		size, err := parseSize(temp.MaxObjectSize)
+		if err != nil {
+			return fmt.Errorf("invalid max_object_size: %w", err)
+		}
+		raw.MaxObjectSize = size
+	}
+
+	if temp.CompleteOnDisconnectMaxSize != "" {
+		size, err := parseSize(temp.CompleteOnDisconnectMaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid complete_on_disconnect_max_size: %w", err)
+		}
+		raw.CompleteOnDisconnectMaxSize = size
+	}
+
 	*p = PolicyConfig(raw)
 	return nil
 }
 
+func (h *HealthConfig) UnmarshalYAML(node *yaml.Node) error {
+	var temp struct {
+		FailureThreshold int    `yaml:"failure_threshold"`
+		OpenTimeout      string `yaml:"open_timeout"`
+		ProbePath        string `yaml:"probe_path"`
+		ProbeInterval    string `yaml:"probe_interval"`
+		ProbeTimeout     string `yaml:"probe_timeout"`
+	}
+
+	if err := node.Decode(&temp); err != nil {
+		return err
+	}
+
+	h.FailureThreshold = temp.FailureThreshold
+	h.ProbePath = temp.ProbePath
+
+	if temp.OpenTimeout != "" {
+		dur, err := parseDuration(temp.OpenTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid open_timeout: %w", err)
+		}
+		h.OpenTimeout = dur
+	}
+
+	if temp.ProbeInterval != "" {
+		dur, err := parseDuration(temp.ProbeInterval)
+		if err != nil {
+			return fmt.Errorf("invalid probe_interval: %w", err)
+		}
+		h.ProbeInterval = dur
+	}
+
+	if temp.ProbeTimeout != "" {
+		dur, err := parseDuration(temp.ProbeTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid probe_timeout: %w", err)
+		}
+		h.ProbeTimeout = dur
+	}
+
+	return nil
+}
+
+func (r *RedirectConfig) UnmarshalYAML(node *yaml.Node) error {
+	var temp struct {
+		Mode         string   `yaml:"mode"`
+		AllowedHosts []string `yaml:"allowed_hosts"`
+		CacheTTL     string   `yaml:"cache_ttl"`
+	}
+
+	if err := node.Decode(&temp); err != nil {
+		return err
+	}
+
+	r.Mode = temp.Mode
+	r.AllowedHosts = temp.AllowedHosts
+
+	if temp.CacheTTL != "" {
+		dur, err := parseDuration(temp.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("invalid cache_ttl: %w", err)
+		}
+		r.CacheTTL = dur
+	}
+
+	return nil
+}
+
 // parseDuration extends time.ParseDuration to support days (d)
 func parseDuration(s string) (time.Duration, error) {
 	// Try standard parsing first
@@ -264,6 +561,19 @@ func (c *Config) Validate() error {
 		c.Server.Listeners = []ListenerConfig{{Addr: ":8080"}}
 	}
 
+	var forward bool
+	for i, l := range c.Server.Listeners {
+		switch l.Mode {
+		case "":
+			c.Server.Listeners[i].Mode = "reverse"
+		case "reverse":
+		case "forward":
+			forward = true
+		default:
+			return fmt.Errorf("listener %s: mode must be reverse or forward", l.Addr)
+		}
+	}
+
 	if c.Cache.Dir == "" {
 		return fmt.Errorf("cache.dir is required")
 	}
@@ -272,56 +582,189 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("cache.max_size_bytes must be positive")
 	}
 
-	if len(c.Policies) == 0 {
-		return fmt.Errorf("at least one policy is required")
+	if c.Cache.LockTimeout <= 0 {
+		c.Cache.LockTimeout = 30 * time.Second
+	}
+
+	if c.Cache.FillIdleTimeout <= 0 {
+		c.Cache.FillIdleTimeout = time.Minute
+	}
+
+	switch c.Cache.Encoding {
+	case "":
+		c.Cache.Encoding = "vary"
+	case "vary", "identity":
+	default:
+		return fmt.Errorf("cache.encoding must be vary or identity")
 	}
 
-	// Compile regex patterns
 	for i := range c.Policies {
-		re, err := regexp.Compile(c.Policies[i].Regex)
-		if err != nil {
-			return fmt.Errorf("policy %s: invalid regex: %w", c.Policies[i].Name, err)
+		if err := c.Policies[i].validate(); err != nil {
+			return err
 		}
-		c.Policies[i].CompiledRegex = re
 	}
 
-	if len(c.Upstreams) == 0 {
+	if len(c.Upstreams) == 0 && !c.Dynamic.Enabled {
 		return fmt.Errorf("at least one upstream is required")
 	}
 
-	return nil
-}
+	for name, upstream := range c.Upstreams {
+		// base_url is optional when mirrors are listed; the first mirror
+		// then becomes the canonical URL used for cache keys
+		if upstream.BaseURL == "" {
+			if len(upstream.Mirrors) == 0 {
+				return fmt.Errorf("upstream %s: base_url or mirrors is required", name)
+			}
+			upstream.BaseURL = upstream.Mirrors[0]
+		}
 
-func (c *Config) MatchPolicy(path string) *PolicyConfig {
-	for i := range c.Policies {
-		if c.Policies[i].CompiledRegex.MatchString(path) {
-			return &c.Policies[i]
+		for _, mirror := range upstream.MirrorURLs() {
+			u, err := url.Parse(mirror)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("upstream %s: invalid mirror URL %q", name, mirror)
+			}
+		}
+
+		// Health defaults
+		if upstream.Health.FailureThreshold <= 0 {
+			upstream.Health.FailureThreshold = 3
+		}
+		if upstream.Health.OpenTimeout <= 0 {
+			upstream.Health.OpenTimeout = 30 * time.Second
+		}
+		if upstream.Health.ProbeInterval <= 0 {
+			upstream.Health.ProbeInterval = 30 * time.Second
+		}
+		if upstream.Health.ProbeTimeout <= 0 {
+			upstream.Health.ProbeTimeout = 10 * time.Second
+		}
+
+		if upstream.Metalink != "" {
+			if upstream.Type != "rpm" && upstream.Type != "zypper" {
+				return fmt.Errorf("upstream %s: metalink requires type rpm or zypper", name)
+			}
+			u, err := url.Parse(upstream.Metalink)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("upstream %s: invalid metalink URL %q", name, upstream.Metalink)
+			}
+		}
+
+		if upstream.Redirects.Mode == "" {
+			upstream.Redirects.Mode = "pass"
+			if upstream.Type == "rpm" || upstream.Type == "zypper" {
+				upstream.Redirects.Mode = "follow"
+			}
+		}
+		if upstream.Redirects.Mode != "pass" && upstream.Redirects.Mode != "follow" {
+			return fmt.Errorf("upstream %s: invalid redirects.mode %q (use pass or follow)", name, upstream.Redirects.Mode)
+		}
+		if upstream.Redirects.CacheTTL < 0 {
+			return fmt.Errorf("upstream %s: redirects.cache_ttl must not be negative", name)
+		}
+		for i, host := range upstream.Redirects.AllowedHosts {
+			if host == "" {
+				return fmt.Errorf("upstream %s: redirects.allowed_hosts[%d] is empty", name, i)
+			}
+			upstream.Redirects.AllowedHosts[i] = normalizeHost(host)
+		}
+
+		if len(upstream.TrustedKeys) > 0 {
+			if upstream.Type == "" {
+				return fmt.Errorf("upstream %s: trusted_keys requires a type", name)
+			}
+			keyring, err := signature.LoadKeyring(upstream.TrustedKeys)
+			if err != nil {
+				return fmt.Errorf("upstream %s: trusted_keys: %w", name, err)
+			}
+			upstream.Keyring = keyring
+		}
+
+		c.Upstreams[name] = upstream
+	}
+
+	if err := c.buildRoutes(); err != nil {
+		return err
+	}
+
+	if err := c.buildPresets(); err != nil {
+		return err
+	}
+	if len(c.Policies) == 0 && len(c.presets) == 0 {
+		return fmt.Errorf("at least one policy or typed upstream is required")
+	}
+
+	if err := c.validateDynamic(); err != nil {
+		return err
+	}
+
+	if forward && len(c.ForwardProxy.AllowedHosts) == 0 {
+		return fmt.Errorf("forward_proxy.allowed_hosts is required with a forward listener")
+	}
+	for i, fh := range c.ForwardProxy.AllowedHosts {
+		if fh.Host == "" {
+			return fmt.Errorf("forward_proxy.allowed_hosts[%d]: host is required", i)
+		}
+		if _, ok := c.Upstreams[fh.Upstream]; fh.Upstream != "" && !ok {
+			return fmt.Errorf("forward_proxy.allowed_hosts[%d]: unknown upstream %s", i, fh.Upstream)
 		}
+		c.ForwardProxy.AllowedHosts[i].Host = strings.ToLower(fh.Host)
 	}
+
 	return nil
 }
 
-// MatchUpstream matches an upstream by path, considering path_prefix
-func (c *Config) MatchUpstream(path string) (string, *UpstreamConfig, string) {
-	for name, upstream := range c.Upstreams {
-		prefix := upstream.PathPrefix
-		if prefix == "" {
-			prefix = "/" + name + "/"
+// CachesNegative reports whether responses with status are negatively cached
+func (p *PolicyConfig) CachesNegative(status int) bool {
+	if p.NegativeTTL <= 0 || p.Action != "cache" {
+		return false
+	}
+	for _, s := range p.NegativeStatuses {
+		if s == status {
+			return true
 		}
+	}
+	return false
+}
 
-		// Ensure prefix starts with / and ends with /
-		if prefix[0] != '/' {
-			prefix = "/" + prefix
-		}
-		if prefix[len(prefix)-1] != '/' {
-			prefix = prefix + "/"
+// DisconnectFillLimit returns how many bytes a download may have once all of
+// its clients have disconnected and still be finished into the cache, or -1
+// for no limit
+func (p *PolicyConfig) DisconnectFillLimit() int64 {
+	switch p.CompleteOnDisconnect {
+	case "never":
+		return 0
+	case "limit":
+		return p.CompleteOnDisconnectMaxSize
+	default:
+		return -1
+	}
+}
+
+// AllowsHost reports whether allowed_hosts lets a redirect to host be
+// followed. An empty list allows no other hosts.
+func (r *RedirectConfig) AllowsHost(host string) bool {
+	host = normalizeHost(host)
+	for _, pattern := range r.AllowedHosts {
+		if hostMatches(pattern, host) {
+			return true
 		}
+	}
+	return false
+}
 
-		// Check if path matches this upstream
-		if len(path) >= len(prefix) && path[:len(prefix)] == prefix {
-			rest := path[len(prefix):]
-			return name, &upstream, rest
+// MirrorURLs returns the base URLs to try for this upstream, in order.
+// The canonical base_url always comes first; duplicates are dropped.
+func (u *UpstreamConfig) MirrorURLs() []string {
+	urls := make([]string, 0, len(u.Mirrors)+1)
+	seen := make(map[string]bool)
+
+	for _, m := range append([]string{u.BaseURL}, u.Mirrors...) {
+		if m == "" || seen[m] {
+			continue
 		}
+		seen[m] = true
+		urls = append(urls, m)
 	}
-	return "", nil, ""
+
+	return urls
 }
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dynamicHostPattern restricts dynamic hosts to plain host names with an
+// optional port, so they are safe to use as cache directory names
+var dynamicHostPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?(:[0-9]+)?$`)
+
+// DynamicRepoPrefix prefixes the cache namespace of each dynamic host
+const DynamicRepoPrefix = "https-"
+
+func (c *Config) validateDynamic() error {
+	if !c.Dynamic.Enabled {
+		return nil
+	}
+
+	if c.Dynamic.PathPrefix == "" {
+		c.Dynamic.PathPrefix = "/HTTPS///"
+	}
+	if !strings.HasPrefix(c.Dynamic.PathPrefix, "/") {
+		c.Dynamic.PathPrefix = "/" + c.Dynamic.PathPrefix
+	}
+
+	if len(c.Dynamic.Allow) == 0 {
+		return fmt.Errorf("dynamic_upstreams.allow is required when dynamic upstreams are enabled")
+	}
+
+	for i := range c.Dynamic.Allow {
+		allow := &c.Dynamic.Allow[i]
+		allow.Host = strings.ToLower(allow.Host)
+		if allow.Host == "" {
+			return fmt.Errorf("dynamic_upstreams.allow[%d]: host is required", i)
+		}
+
+		allow.CompiledPaths = nil
+		for _, expr := range allow.Paths {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("dynamic_upstreams.allow[%d]: invalid path regex: %w", i, err)
+			}
+			allow.CompiledPaths = append(allow.CompiledPaths, re)
+		}
+	}
+
+	return nil
+}
+
+// allows reports whether the rule admits path on host
+func (a *DynamicAllowConfig) allows(host, path string) bool {
+	if !hostMatches(a.Host, host) {
+		return false
+	}
+	if len(a.CompiledPaths) == 0 {
+		return true
+	}
+	for _, re := range a.CompiledPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDynamic builds an HTTPS upstream from a path such as
+// /HTTPS///download.docker.com/linux/ubuntu/dists/jammy/InRelease. The host
+// and path must be allowed by dynamic_upstreams.allow. Each host gets its
+// own cache namespace ("https-download.docker.com"), returned as the
+// upstream name along with the cleaned path below the host. Paths with ".."
+// segments are refused, so the allowlist sees the path that is fetched.
+func (c *Config) MatchDynamic(reqPath string) (string, *UpstreamConfig, string) {
+	if !c.Dynamic.Enabled || !strings.HasPrefix(reqPath, c.Dynamic.PathPrefix) {
+		return "", nil, ""
+	}
+
+	host, rest, _ := strings.Cut(strings.TrimPrefix(reqPath, c.Dynamic.PathPrefix), "/")
+	host = strings.ToLower(host)
+	if !dynamicHostPattern.MatchString(host) {
+		return "", nil, ""
+	}
+
+	for _, segment := range strings.Split(rest, "/") {
+		if segment == ".." {
+			return "", nil, ""
+		}
+	}
+	rest = strings.TrimPrefix(path.Clean("/"+rest), "/")
+
+	allowed := false
+	for i := range c.Dynamic.Allow {
+		if c.Dynamic.Allow[i].allows(host, "/"+rest) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", nil, ""
+	}
+
+	upstream := &UpstreamConfig{
+		BaseURL: "https://" + host,
+		Health: HealthConfig{
+			FailureThreshold: 3,
+			OpenTimeout:      30 * time.Second,
+		},
+	}
+	return DynamicRepoPrefix + host, upstream, rest
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PolicyMatch describes a request for policy matching
+type PolicyMatch struct {
+	Upstream    string // Upstream name
+	Method      string
+	Path        string // Path below the upstream prefix
+	Query       string // Raw query string
+	ContentType string // Response Content-Type, "" until the response is known
+}
+
+// validate compiles the policy's regex and fills in defaults
+func (p *PolicyConfig) validate() error {
+	re, err := regexp.Compile(p.Regex)
+	if err != nil {
+		return fmt.Errorf("policy %s: invalid regex: %w", p.Name, err)
+	}
+	p.CompiledRegex = re
+
+	switch p.CompleteOnDisconnect {
+	case "", "always", "never":
+	case "limit":
+		if p.CompleteOnDisconnectMaxSize <= 0 {
+			return fmt.Errorf("policy %s: complete_on_disconnect_max_size is required with complete_on_disconnect: limit", p.Name)
+		}
+	default:
+		return fmt.Errorf("policy %s: complete_on_disconnect must be always, never or limit", p.Name)
+	}
+
+	switch p.RangeOnMiss {
+	case "":
+		p.RangeOnMiss = "fill"
+	case "fill", "proxy":
+	default:
+		return fmt.Errorf("policy %s: range_on_miss must be fill or proxy", p.Name)
+	}
+
+	switch p.Freshness {
+	case "":
+		p.Freshness = "policy"
+	case "policy", "upstream", "clamp":
+	default:
+		return fmt.Errorf("policy %s: freshness must be policy, upstream or clamp", p.Name)
+	}
+	if p.MaxTTL > 0 && p.MinTTL > p.MaxTTL {
+		return fmt.Errorf("policy %s: min_ttl must not exceed max_ttl", p.Name)
+	}
+
+	if err := p.validateScope(); err != nil {
+		return fmt.Errorf("policy %s: %w", p.Name, err)
+	}
+
+	if p.NegativeTTL > 0 && len(p.NegativeStatuses) == 0 {
+		p.NegativeStatuses = []int{404, 410}
+	}
+	for _, status := range p.NegativeStatuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("policy %s: negative_statuses must be 4xx or 5xx codes, got %d", p.Name, status)
+		}
+	}
+	return nil
+}
+
+func (p *PolicyConfig) validateScope() error {
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+
+	for _, pattern := range p.Upstreams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid upstream pattern %q: %w", pattern, err)
+		}
+	}
+
+	switch p.Query {
+	case "":
+		p.Query = "any"
+	case "any", "none", "present":
+	default:
+		return fmt.Errorf("query must be any, none or present")
+	}
+
+	switch p.Action {
+	case "":
+		p.Action = "cache"
+	case "cache", "no-store", "bypass":
+	default:
+		return fmt.Errorf("action must be cache, no-store or bypass")
+	}
+
+	if p.MaxObjectSize > 0 && p.MinObjectSize > p.MaxObjectSize {
+		return fmt.Errorf("min_object_size must not exceed max_object_size")
+	}
+
+	return nil
+}
+
+// matches reports whether the policy applies to the request. Policies
+// scoped to content types never match while the content type is unknown.
+func (p *PolicyConfig) matches(m PolicyMatch) bool {
+	if !p.CompiledRegex.MatchString(m.Path) {
+		return false
+	}
+
+	if !p.scopedTo(m.Upstream) {
+		return false
+	}
+
+	if len(p.Methods) > 0 {
+		matched := false
+		for _, method := range p.Methods {
+			if method == m.Method {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	switch p.Query {
+	case "none":
+		if m.Query != "" {
+			return false
+		}
+	case "present":
+		if m.Query == "" {
+			return false
+		}
+	}
+
+	if len(p.ContentTypes) > 0 {
+		if m.ContentType == "" {
+			return false
+		}
+		contentType := strings.ToLower(m.ContentType)
+		matched := false
+		for _, prefix := range p.ContentTypes {
+			if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scopedTo reports whether the policy applies to the named upstream
+func (p *PolicyConfig) scopedTo(upstream string) bool {
+	if len(p.Upstreams) == 0 {
+		return true
+	}
+	for _, pattern := range p.Upstreams {
+		if ok, _ := path.Match(pattern, upstream); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPolicy returns the first policy that applies to the request, or nil.
+// For an upstream with a type, explicit policies scoped to it come first,
+// then the preset's policies, then the remaining explicit policies and
+// finally the preset's catch-all policy.
+func (c *Config) MatchPolicy(m PolicyMatch) *PolicyConfig {
+	if presets := c.presets[m.Upstream]; len(presets) > 0 {
+		for i := range c.Policies {
+			if len(c.Policies[i].Upstreams) > 0 && c.Policies[i].matches(m) {
+				return &c.Policies[i]
+			}
+		}
+		for i := range presets {
+			if presets[i].matches(m) {
+				return &presets[i]
+			}
+		}
+	}
+
+	for i := range c.Policies {
+		if c.Policies[i].matches(m) {
+			return &c.Policies[i]
+		}
+	}
+
+	if fallback := c.fallbacks[m.Upstream]; fallback != nil && fallback.matches(m) {
+		return fallback
+	}
+	return nil
+}
+
+// Stores reports whether a response of the given size (-1 if unknown) may
+// be written to the cache under this policy
+func (p *PolicyConfig) Stores(size int64) bool {
+	if p.Action != "cache" {
+		return false
+	}
+	if p.MaxObjectSize > 0 && (size < 0 || size > p.MaxObjectSize) {
+		return false
+	}
+	if p.MinObjectSize > 0 && size >= 0 && size < p.MinObjectSize {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Preset TTLs: index files change in place, packages and checksum-named
+// files never do
+const (
+	presetIndexTTL     = 30 * time.Minute
+	presetIndexStale   = 7 * 24 * time.Hour
+	presetNegativeTTL  = 5 * time.Minute
+	presetImmutableTTL = 365 * 24 * time.Hour
+)
+
+// indexPolicy is a preset policy for mutable metadata. Missing files are
+// remembered briefly since clients probe for several compressions.
+func indexPolicy(name, regex string) PolicyConfig {
+	return PolicyConfig{
+		Name:         name,
+		Regex:        regex,
+		CacheTTL:     presetIndexTTL,
+		StaleIfError: presetIndexStale,
+		NegativeTTL:  presetNegativeTTL,
+	}
+}
+
+// immutablePolicy is a preset policy for files whose content never changes
+// under the same name
+func immutablePolicy(name, regex string) PolicyConfig {
+	return PolicyConfig{
+		Name:                      name,
+		Regex:                     regex,
+		CacheTTL:                  presetImmutableTTL,
+		AllowStaleWhileRevalidate: true,
+	}
+}
+
+// presetPolicies are the policies each upstream type brings, in match order.
+// Regexes match the path below the upstream prefix.
+var presetPolicies = map[string][]PolicyConfig{
+	"apt": {
+		immutablePolicy("apt-by-hash", `(^|/)by-hash/(MD5Sum|SHA1|SHA256|SHA512)/[0-9a-f]+$`),
+		indexPolicy("apt-release", `(^|/)(InRelease|Release|Release\.gpg)$`),
+		indexPolicy("apt-indices", `(^|/)dists/|(^|/)(Packages|Sources)(\.(gz|bz2|xz|lzma|zst))?$`),
+		immutablePolicy("apt-packages", `\.(deb|udeb|ddeb|dsc|changes|buildinfo|diff\.gz|tar\.(gz|bz2|xz|lzma|zst))$`),
+	},
+	"rpm": {
+		immutablePolicy("rpm-repodata", `(^|/)repodata/[0-9a-f]{32,}-[^/]+$`),
+		indexPolicy("rpm-metadata", `(^|/)(repodata/[^/]+|\.?treeinfo|media\.repo|RPM-GPG-KEY[^/]*)$`),
+		immutablePolicy("rpm-packages", `\.(rpm|drpm)$`),
+	},
+	"apk": {
+		indexPolicy("apk-index", `(^|/)(APKINDEX\.tar\.gz|latest-releases\.yaml)$`),
+		immutablePolicy("apk-packages", `\.apk$`),
+	},
+	"pacman": {
+		indexPolicy("pacman-db", `(\.(db|files)(\.tar\.(gz|bz2|xz|zst))?(\.sig)?|(^|/)(lastsync|lastupdate))$`),
+		immutablePolicy("pacman-packages", `\.pkg\.tar(\.(gz|bz2|xz|zst|lz4|lrz|lzo|Z))?(\.sig)?$`),
+	},
+	"zypper": {
+		immutablePolicy("zypper-repodata", `(^|/)repodata/[0-9a-f]{32,}-[^/]+$`),
+		indexPolicy("zypper-metadata", `(^|/)(repodata/[^/]+|media\.1/[^/]+|content(\.asc|\.key)?|CHECKSUMS(\.asc)?|\.treeinfo)$`),
+		immutablePolicy("zypper-packages", `\.(rpm|drpm)$`),
+	},
+}
+
+// otherPolicy is the catch-all preset policy of an upstream type for files
+// none of its other policies cover (READMEs, Contents indices, ...). They
+// are treated like index files, since they may change in place.
+func otherPolicy(upstreamType string) PolicyConfig {
+	return indexPolicy(upstreamType+"-other", `.*`)
+}
+
+// presetTypes returns the known upstream types for error messages
+func presetTypes() string {
+	types := make([]string, 0, len(presetPolicies))
+	for t := range presetPolicies {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// buildPresets compiles the preset policies of every typed upstream,
+// including its catch-all policy. An explicit policy with the same name as a
+// preset policy takes its place for the upstreams it applies to.
+func (c *Config) buildPresets() error {
+	explicit := make(map[string]*PolicyConfig, len(c.Policies))
+	for i := range c.Policies {
+		explicit[c.Policies[i].Name] = &c.Policies[i]
+	}
+
+	c.presets = make(map[string][]PolicyConfig)
+	c.fallbacks = make(map[string]*PolicyConfig)
+	for name, upstream := range c.Upstreams {
+		if upstream.Type == "" {
+			continue
+		}
+		defaults, ok := presetPolicies[upstream.Type]
+		if !ok {
+			return fmt.Errorf("upstream %s: type must be one of %s", name, presetTypes())
+		}
+
+		policies := make([]PolicyConfig, 0, len(defaults)+1)
+		for _, p := range append(defaults, otherPolicy(upstream.Type)) {
+			if override, ok := explicit[p.Name]; ok && override.scopedTo(name) {
+				policies = append(policies, *override)
+				continue
+			}
+
+			p.Upstreams = []string{name}
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("upstream %s: %w", name, err)
+			}
+			policies = append(policies, p)
+		}
+
+		// The catch-all comes after the explicit policies that are not
+		// scoped to the upstream
+		last := len(policies) - 1
+		c.presets[name] = policies[:last]
+		c.fallbacks[name] = &policies[last]
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// route is a compiled upstream match rule
+type route struct {
+	name     string
+	prefix   string   // Normalized, always starts and ends with /
+	hosts    []string // Lower-case host names or "*.suffix" wildcards; empty matches any host
+	priority int
+}
+
+// normalizePrefix returns the path prefix an upstream is mounted at. Without
+// path_prefix it is /{name}/, or / for upstreams routed by host.
+func normalizePrefix(name string, upstream UpstreamConfig) string {
+	prefix := upstream.PathPrefix
+	if prefix == "" {
+		if len(upstream.Hosts) > 0 {
+			return "/"
+		}
+		prefix = "/" + name + "/"
+	}
+
+	// Ensure prefix starts with / and ends with /
+	if prefix[0] != '/' {
+		prefix = "/" + prefix
+	}
+	if prefix[len(prefix)-1] != '/' {
+		prefix = prefix + "/"
+	}
+	return prefix
+}
+
+// buildRoutes compiles the upstreams into routes ordered by match
+// precedence: higher priority first, then upstreams restricted to hosts,
+// then longer prefixes, then name so the order never depends on map
+// iteration
+func (c *Config) buildRoutes() error {
+	routes := make([]route, 0, len(c.Upstreams))
+	for name, upstream := range c.Upstreams {
+		hosts := make([]string, 0, len(upstream.Hosts))
+		for _, host := range upstream.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" {
+				return fmt.Errorf("upstream %s: empty host", name)
+			}
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+
+		routes = append(routes, route{
+			name:     name,
+			prefix:   normalizePrefix(name, upstream),
+			hosts:    hosts,
+			priority: upstream.Priority,
+		})
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if (len(a.hosts) > 0) != (len(b.hosts) > 0) {
+			return len(a.hosts) > 0
+		}
+		if len(a.prefix) != len(b.prefix) {
+			return len(a.prefix) > len(b.prefix)
+		}
+		return a.name < b.name
+	})
+
+	// Two upstreams that can match exactly the same requests are a config
+	// error. They need not be neighbours in the sorted order.
+	seen := make(map[string]string, len(routes))
+	for _, rt := range routes {
+		key := fmt.Sprintf("%d %s %s", rt.priority, rt.prefix, strings.Join(rt.hosts, ","))
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("upstreams %s and %s have the same path_prefix, hosts and priority", other, rt.name)
+		}
+		seen[key] = rt.name
+	}
+
+	c.routes = routes
+	return nil
+}
+
+// matches reports whether the route applies to the host and path
+func (rt *route) matches(host, path string) bool {
+	if !strings.HasPrefix(path, rt.prefix) {
+		return false
+	}
+	if len(rt.hosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range rt.hosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches matches a lower-case host against a name or "*.suffix" pattern
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// normalizeHost strips the port and trailing dot and lower-cases a host
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// MatchUpstream picks the upstream for a request by Host header and path.
+// Among the upstreams that match, the highest priority wins, then one
+// restricted to the host, then the longest path_prefix. It returns the
+// upstream name, its config and the path below the prefix.
+func (c *Config) MatchUpstream(host, path string) (string, *UpstreamConfig, string) {
+	host = normalizeHost(host)
+
+	for i := range c.routes {
+		rt := &c.routes[i]
+		if !rt.matches(host, path) {
+			continue
+		}
+
+		upstream := c.Upstreams[rt.name]
+		return rt.name, &upstream, path[len(rt.prefix):]
+	}
+	return "", nil, ""
+}
+
+// MatchForward maps a forward-proxy request for host and path onto an
+// upstream through forward_proxy.allowed_hosts. The path must lie below the
+// path of the upstream's base_url or one of its mirrors; the remainder is
+// returned as with MatchUpstream. Hosts off the allowlist match nothing.
+func (c *Config) MatchForward(host, path string) (string, *UpstreamConfig, string) {
+	host = normalizeHost(host)
+
+	for _, fh := range c.ForwardProxy.AllowedHosts {
+		if !hostMatches(fh.Host, host) {
+			continue
+		}
+
+		names := []string{fh.Upstream}
+		if fh.Upstream == "" {
+			names = c.upstreamsForHost(host)
+		}
+
+		// The longest matching base path wins, e.g. /debian-security over /
+		var bestName, bestBase string
+		for _, name := range names {
+			upstream := c.Upstreams[name]
+			for _, mirror := range upstream.MirrorURLs() {
+				u, err := url.Parse(mirror)
+				if err != nil {
+					continue
+				}
+				base := strings.TrimSuffix(u.Path, "/") + "/"
+				if strings.HasPrefix(path, base) && len(base) > len(bestBase) {
+					bestName, bestBase = name, base
+				}
+			}
+		}
+
+		if bestName != "" {
+			upstream := c.Upstreams[bestName]
+			return bestName, &upstream, path[len(bestBase):]
+		}
+	}
+	return "", nil, ""
+}
+
+// upstreamsForHost returns the upstreams, by name, whose base_url or
+// mirrors are on host
+func (c *Config) upstreamsForHost(host string) []string {
+	var names []string
+	for name, upstream := range c.Upstreams {
+		for _, mirror := range upstream.MirrorURLs() {
+			if u, err := url.Parse(mirror); err == nil && normalizeHost(u.Host) == host {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,90 @@
+package health
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// StartProbes begins active probing of every upstream that has a probe_path
+// configured. Probes go through the given client so they share the proxy's
+// transport (timeouts, egress proxy).
+func (t *Tracker) StartProbes(client *http.Client) {
+	for name, upstream := range t.config.Upstreams {
+		if upstream.Health.ProbePath == "" {
+			continue
+		}
+		for _, mirror := range upstream.MirrorURLs() {
+			go t.probeLoop(client, name, mirror)
+		}
+		log.Printf("health: probing %s every %s", name, upstream.Health.ProbeInterval)
+	}
+}
+
+// Stop stops all probe loops
+func (t *Tracker) Stop() {
+	close(t.stopCh)
+}
+
+func (t *Tracker) probeLoop(client *http.Client, upstream, mirror string) {
+	cfg := t.settings(upstream)
+
+	ticker := time.NewTicker(cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	// Probe immediately on start
+	t.probe(client, upstream, mirror)
+
+	for {
+		select {
+		case <-ticker.C:
+			t.probe(client, upstream, mirror)
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+// probe sends a HEAD request for the probe path and records the outcome.
+// Probes bypass the circuit so that an open mirror can be closed as soon as
+// it recovers.
+func (t *Tracker) probe(client *http.Client, upstream, mirror string) {
+	cfg := t.config.Upstreams[upstream]
+
+	probeURL, err := url.Parse(mirror)
+	if err != nil {
+		return
+	}
+	probeURL.Path = path.Join(probeURL.Path, cfg.Health.ProbePath)
+
+	req, err := http.NewRequest(http.MethodHead, probeURL.String(), nil)
+	if err != nil {
+		return
+	}
+	for key, value := range cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	probeClient := *client
+	probeClient.Timeout = cfg.Health.ProbeTimeout
+
+	start := time.Now()
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		t.RecordFailure(upstream, mirror, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		t.RecordFailure(upstream, mirror, fmt.Errorf("probe returned %d", resp.StatusCode))
+		return
+	}
+
+	t.RecordSuccess(upstream, mirror, time.Since(start))
+}
@@ -0,0 +1,245 @@
+package health
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+)
+
+// State is the circuit breaker state of a mirror
+type State int
+
+const (
+	// StateClosed lets all requests through
+	StateClosed State = iota
+	// StateHalfOpen lets a single trial request through
+	StateHalfOpen
+	// StateOpen fails requests fast until the open timeout elapses
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCircuitOpen is returned when every mirror of an upstream has an open circuit
+var ErrCircuitOpen = errors.New("all mirrors unavailable (circuit open)")
+
+// latencyWeight is the EWMA weight given to each new latency sample
+const latencyWeight = 0.2
+
+// mirrorHealth holds the health state of a single mirror base URL
+type mirrorHealth struct {
+	upstream            string
+	mirror              string
+	state               State
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+	trialStarted        time.Time
+	latency             time.Duration
+	successes           int64
+	failures            int64
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	lastError           string
+}
+
+// MirrorStatus is a point-in-time snapshot of a mirror's health
+type MirrorStatus struct {
+	Upstream            string    `json:"upstream"`
+	Mirror              string    `json:"mirror"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LatencySeconds      float64   `json:"latency_seconds"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+// Tracker records upstream health from real fetches and probes, and runs a
+// circuit breaker per mirror
+type Tracker struct {
+	mu      sync.Mutex
+	config  *config.Config
+	mirrors map[string]*mirrorHealth
+	stopCh  chan struct{}
+}
+
+// NewTracker creates a tracker with every configured mirror in the closed state
+func NewTracker(cfg *config.Config) *Tracker {
+	t := &Tracker{
+		config:  cfg,
+		mirrors: make(map[string]*mirrorHealth),
+		stopCh:  make(chan struct{}),
+	}
+
+	for name, upstream := range cfg.Upstreams {
+		for _, mirror := range upstream.MirrorURLs() {
+			t.get(name, mirror)
+		}
+	}
+
+	return t
+}
+
+func mirrorKey(upstream, mirror string) string {
+	return upstream + "|" + mirror
+}
+
+// get returns the health entry for a mirror, creating it if needed.
+// Caller must hold t.mu.
+func (t *Tracker) get(upstream, mirror string) *mirrorHealth {
+	key := mirrorKey(upstream, mirror)
+	m, ok := t.mirrors[key]
+	if !ok {
+		m = &mirrorHealth{upstream: upstream, mirror: mirror}
+		t.mirrors[key] = m
+		metrics.UpstreamCircuitState.WithLabelValues(upstream, mirror).Set(float64(StateClosed))
+	}
+	return m
+}
+
+// settings returns the health config for an upstream, falling back to
+// defaults for upstreams that are not in the static config
+func (t *Tracker) settings(upstream string) config.HealthConfig {
+	if u, ok := t.config.Upstreams[upstream]; ok {
+		return u.Health
+	}
+	return config.HealthConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// Allow reports whether a request may be sent to the mirror. An open
+// circuit whose timeout has elapsed moves to half-open and admits a single
+// trial request.
+func (t *Tracker) Allow(upstream, mirror string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := t.get(upstream, mirror)
+
+	switch m.state {
+	case StateOpen:
+		if time.Since(m.openedAt) < t.settings(upstream).OpenTimeout {
+			return false
+		}
+		t.setState(m, StateHalfOpen)
+		m.trialInFlight = true
+		m.trialStarted = time.Now()
+		return true
+	case StateHalfOpen:
+		// A trial that never reported back (e.g. client went away) must not
+		// keep the mirror half-open forever
+		if m.trialInFlight && time.Since(m.trialStarted) < t.settings(upstream).OpenTimeout {
+			return false
+		}
+		m.trialInFlight = true
+		m.trialStarted = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordSuccess records a successful response and its latency, closing the
+// circuit if it was not already closed
+func (t *Tracker) RecordSuccess(upstream, mirror string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := t.get(upstream, mirror)
+	m.successes++
+	m.lastSuccess = time.Now()
+	m.consecutiveFailures = 0
+	m.trialInFlight = false
+
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(m.latency))
+	}
+	metrics.UpstreamLatency.WithLabelValues(upstream, mirror).Set(m.latency.Seconds())
+
+	if m.state != StateClosed {
+		t.setState(m, StateClosed)
+	}
+}
+
+// RecordFailure records a failed request. The circuit opens once the
+// failure threshold is reached, or immediately if a half-open trial fails.
+func (t *Tracker) RecordFailure(upstream, mirror string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := t.get(upstream, mirror)
+	m.failures++
+	m.consecutiveFailures++
+	m.lastFailure = time.Now()
+	m.trialInFlight = false
+	if err != nil {
+		m.lastError = err.Error()
+	}
+	metrics.UpstreamFailures.WithLabelValues(upstream, mirror).Inc()
+
+	if m.state == StateHalfOpen || m.consecutiveFailures >= t.settings(upstream).FailureThreshold {
+		m.openedAt = time.Now()
+		if m.state != StateOpen {
+			t.setState(m, StateOpen)
+		}
+	}
+}
+
+// setState changes a mirror's state and updates the gauge. Caller must hold t.mu.
+func (t *Tracker) setState(m *mirrorHealth, state State) {
+	m.state = state
+	metrics.UpstreamCircuitState.WithLabelValues(m.upstream, m.mirror).Set(float64(state))
+}
+
+// Snapshot returns the current health of every known mirror
+func (t *Tracker) Snapshot() []MirrorStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make([]MirrorStatus, 0, len(t.mirrors))
+	for _, m := range t.mirrors {
+		statuses = append(statuses, MirrorStatus{
+			Upstream:            m.upstream,
+			Mirror:              m.mirror,
+			State:               m.state.String(),
+			ConsecutiveFailures: m.consecutiveFailures,
+			LatencySeconds:      m.latency.Seconds(),
+			Successes:           m.successes,
+			Failures:            m.failures,
+			LastSuccess:         m.lastSuccess,
+			LastFailure:         m.lastFailure,
+			LastError:           m.lastError,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Upstream != statuses[j].Upstream {
+			return statuses[i].Upstream < statuses[j].Upstream
+		}
+		return statuses[i].Mirror < statuses[j].Mirror
+	})
+
+	return statuses
+}
@@ -56,6 +56,13 @@ func (j *Janitor) run() {
 }
 
 func (j *Janitor) cleanup() {
+	// Expired negative entries take no disk space but would pile up
+	if pruned, err := j.index.PruneNegative(); err != nil {
+		log.Printf("janitor: failed to prune negative entries: %v", err)
+	} else if pruned > 0 {
+		log.Printf("janitor: pruned %d expired negative entries", pruned)
+	}
+
 	totalSize, err := j.index.TotalSize()
 	if err != nil {
 		log.Printf("janitor: failed to get total size: %v", err)
@@ -75,6 +82,14 @@ func (j *Janitor) cleanup() {
 		return
 	}
 
+	// A shared blob only frees its bytes once its last entry is evicted
+	refs := make(map[string]int)
+	for _, entry := range entries {
+		if entry.Shared && entry.SHA256 != "" {
+			refs[entry.SHA256]++
+		}
+	}
+
 	var evicted int
 	var freedBytes int64
 
@@ -95,6 +110,12 @@ func (j *Janitor) cleanup() {
 		}
 
 		evicted++
+		if entry.Shared && entry.SHA256 != "" {
+			refs[entry.SHA256]--
+			if refs[entry.SHA256] > 0 {
+				continue
+			}
+		}
 		freedBytes += entry.Size
 	}
 
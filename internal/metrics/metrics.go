@@ -53,3 +53,55 @@ var (
 		Help: "Total bytes evicted",
 	})
 )
+
+var (
+	UpstreamCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edgecache_upstream_circuit_state",
+		Help: "Circuit breaker state per mirror (0=closed, 1=half-open, 2=open)",
+	}, []string{"upstream", "mirror"})
+
+	UpstreamLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edgecache_upstream_latency_seconds",
+		Help: "Smoothed time to response headers per mirror",
+	}, []string{"upstream", "mirror"})
+
+	UpstreamFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_upstream_failures_total",
+		Help: "Total number of failed upstream requests and probes per mirror",
+	}, []string{"upstream", "mirror"})
+
+	UpstreamResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_upstream_resumes_total",
+		Help: "Total number of Range retries of interrupted upstream transfers by outcome",
+	}, []string{"repo", "result"})
+
+	UpstreamRedirects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_upstream_redirects_total",
+		Help: "Upstream redirects by result (followed, refused, remembered)",
+	}, []string{"repo", "result"})
+
+	AptIndices = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_apt_indices_total",
+		Help: "Cached APT index files checked against their Release file by result (refreshed, invalidated, outdated_release)",
+	}, []string{"repo", "result"})
+
+	RpmMetadata = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_rpm_metadata_total",
+		Help: "Cached RPM metadata files checked against their repomd.xml by result (refreshed, invalidated, outdated_repomd)",
+	}, []string{"repo", "result"})
+
+	VerifyRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_verify_rejections_total",
+		Help: "Total number of downloads rejected for not matching the checksum their repository metadata lists",
+	}, []string{"repo"})
+
+	SignatureChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgecache_signature_checks_total",
+		Help: "Signature checks of new repository metadata by result (valid, invalid)",
+	}, []string{"repo", "result"})
+
+	SignatureAlert = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edgecache_signature_alert",
+		Help: "1 while the last signature check of an upstream's metadata failed, 0 once one passes",
+	}, []string{"repo"})
+)
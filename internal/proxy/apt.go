@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"repoxy/internal/apt"
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+	"repoxy/internal/storage"
+)
+
+// releaseDir returns the directory of a Release file below the upstream,
+// ending in / unless it is the upstream root
+func releaseDir(rest string) string {
+	if dir := path.Dir(rest); dir != "." {
+		return dir + "/"
+	}
+	return ""
+}
+
+// listedFile looks rest up in the current Release file (or, for RPM
+// upstreams, repomd.xml) of the nearest directory above it that lists it
+func (h *Handler) listedFile(repo, rest string) (string, *storage.ReleaseFile, bool) {
+	for _, dir := range h.releaseDirsAbove(repo, rest) {
+		if file, err := h.index.GetReleaseFile(repo, dir, rest[len(dir):]); err == nil {
+			return dir, file, true
+		}
+	}
+	return "", nil, false
+}
+
+// releaseDirsAbove returns the directories above rest that have a recorded
+// Release file or repomd.xml, nearest first. They are loaded from the index
+// once per upstream and kept up to date by putRelease.
+func (h *Handler) releaseDirsAbove(repo, rest string) []string {
+	h.releaseMu.Lock()
+	defer h.releaseMu.Unlock()
+
+	known, ok := h.releaseDirs[repo]
+	if !ok {
+		list, err := h.index.ReleaseDirs(repo)
+		if err != nil {
+			log.Printf("apt: failed to load Release files of %s: %v", repo, err)
+			return nil
+		}
+		known = make(map[string]bool, len(list))
+		for _, dir := range list {
+			known[dir] = true
+		}
+		h.releaseDirs[repo] = known
+	}
+
+	var dirs []string
+	for i := len(rest); i >= 0; {
+		i = strings.LastIndexByte(rest[:i], '/')
+		if dir := rest[:i+1]; known[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// putRelease records the files the Release file or repomd.xml in dir lists
+func (h *Handler) putRelease(repo, dir string, files map[string]storage.ReleaseFile) error {
+	if err := h.index.PutRelease(repo, dir, files); err != nil {
+		return err
+	}
+
+	h.releaseMu.Lock()
+	if known, ok := h.releaseDirs[repo]; ok {
+		known[dir] = true
+	}
+	h.releaseMu.Unlock()
+	return nil
+}
+
+// listedChecksum returns the size and digest the current Release file or
+// repomd.xml lists for rest, or the zero Checksum if none does
+func (h *Handler) listedChecksum(repo, rest string) cache.Checksum {
+	_, file, ok := h.listedFile(repo, rest)
+	if !ok {
+		return cache.Checksum{}
+	}
+	return cache.Checksum{Size: file.Size, SHA256: file.SHA256}
+}
+
+// matchesRelease reports whether a cached entry holds exactly the bytes a
+// Release file lists. Entries stored with a content coding never match;
+// files listed without a SHA256 are matched by size.
+func matchesRelease(meta *cache.Metadata, file *storage.ReleaseFile) bool {
+	return meta.ContentEncoding == "" && meta.Size == file.Size &&
+		(file.SHA256 == "" || meta.SHA256 == file.SHA256)
+}
+
+// dropEntry removes a cache entry from disk and the index
+func (h *Handler) dropEntry(repo, key string) {
+	if err := h.store.Delete(repo, key); err != nil {
+		log.Printf("apt: failed to delete %s/%s: %v", repo, key, err)
+	}
+	h.index.Delete(repo, key)
+}
+
+// indexChecksum returns the size and digest the current Release file lists
+// for rest, so that a new copy is only stored if it matches. A cached copy
+// under key that does not match is dropped, so it is fetched again instead
+// of handing the client a hash sum mismatch.
+func (h *Handler) indexChecksum(repo, rest, key string) cache.Checksum {
+	_, file, ok := h.listedFile(repo, rest)
+	if !ok {
+		return cache.Checksum{}
+	}
+
+	if meta, err := h.store.GetMetadata(repo, key); err == nil && !matchesRelease(meta, file) {
+		log.Printf("apt: cached %s does not match its Release file, refetching", meta.URL)
+		h.dropEntry(repo, key)
+		metrics.AptIndices.WithLabelValues(repo, "invalidated").Inc()
+	}
+	return cache.Checksum{Size: file.Size, SHA256: file.SHA256}
+}
+
+// aptKey picks the cache key for a request to an APT upstream. by-hash
+// files are stored under their digest. A plain-named index is served from
+// the by-hash copy of the digest its Release file lists when that is cached,
+// otherwise it keeps urlKey. expect is the digest the content stored under
+// a digest key must have.
+func (h *Handler) aptKey(repo, rest, urlKey string) (key, expect string) {
+	if digest := apt.ByHashDigest(rest); digest != "" {
+		return cache.DigestKey(digest), digest
+	}
+
+	if _, file, ok := h.listedFile(repo, rest); ok && file.SHA256 != "" {
+		if digestKey := cache.DigestKey(file.SHA256); h.store.Exists(repo, digestKey) {
+			return digestKey, file.SHA256
+		}
+	}
+
+	return urlKey, ""
+}
+
+// aptFilled runs after an object of an APT upstream was stored. A Release
+// file updates the indices it lists; an index that does not match the
+// current Release file means upstream has published a newer one, so the
+// Release files of its directory are expired to be revalidated next.
+func (h *Handler) aptFilled(repo, key, rest string, upstream config.UpstreamConfig, meta *cache.Metadata) {
+	if apt.IsReleaseFile(rest) {
+		h.refreshRelease(repo, key, rest, upstream)
+		return
+	}
+
+	if _, file, ok := h.listedFile(repo, rest); ok && !matchesRelease(meta, file) {
+		h.releaseOutdated(repo, rest, upstream)
+	}
+}
+
+// releaseOutdated runs after an index that does not match the Release file
+// listing it was fetched. Upstream has most likely published a newer Release
+// file, so the cached ones of its directory are expired to be revalidated
+// next.
+func (h *Handler) releaseOutdated(repo, rest string, upstream config.UpstreamConfig) {
+	dir, _, ok := h.listedFile(repo, rest)
+	if !ok {
+		return
+	}
+
+	log.Printf("apt: %s does not match the cached Release file, expiring it", rest)
+	metrics.AptIndices.WithLabelValues(repo, "outdated_release").Inc()
+
+	for _, name := range []string{"InRelease", "Release"} {
+		releaseURL, err := h.buildUpstreamURL(upstream.BaseURL, dir+name, "")
+		if err != nil {
+			continue
+		}
+		for _, encoding := range append([]string{"identity"}, variantEncodings...) {
+			releaseKey := cache.VariantKey(releaseURL, encoding)
+			releaseMeta, err := h.store.GetMetadata(repo, releaseKey)
+			if err != nil {
+				continue
+			}
+			releaseMeta.ExpiresAt = time.Now()
+			h.store.UpdateMetadata(repo, releaseKey, releaseMeta)
+		}
+	}
+}
+
+// refreshRelease parses a Release file that was just stored or revalidated
+// and records the files it lists. Cached indices it lists are brought in
+// line with it: matching ones take over its freshness, others are dropped.
+func (h *Handler) refreshRelease(repo, key, rest string, upstream config.UpstreamConfig) {
+	f, meta, err := h.store.Get(repo, key)
+	if err != nil {
+		log.Printf("apt: failed to open Release file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if meta.ContentEncoding != "" {
+		return
+	}
+
+	rel, err := apt.ParseRelease(f)
+	if err != nil {
+		log.Printf("apt: failed to parse %s: %v", meta.URL, err)
+		return
+	}
+
+	dir := releaseDir(rest)
+	files := make(map[string]storage.ReleaseFile, len(rel.Files))
+	for name, file := range rel.Files {
+		files[name] = storage.ReleaseFile{Size: file.Size, SHA256: file.SHA256}
+	}
+	if err := h.putRelease(repo, dir, files); err != nil {
+		log.Printf("apt: failed to record %s: %v", meta.URL, err)
+		return
+	}
+
+	var refreshed, invalidated int
+	for name, file := range files {
+		indexURL, err := h.buildUpstreamURL(upstream.BaseURL, dir+name, "")
+		if err != nil {
+			continue
+		}
+
+		for _, encoding := range append([]string{"identity"}, variantEncodings...) {
+			indexKey := cache.VariantKey(indexURL, encoding)
+			indexMeta, err := h.store.GetMetadata(repo, indexKey)
+			if err != nil {
+				continue
+			}
+
+			if matchesRelease(indexMeta, &file) {
+				indexMeta.CreatedAt = meta.CreatedAt
+				indexMeta.ExpiresAt = meta.ExpiresAt
+				h.store.UpdateMetadata(repo, indexKey, indexMeta)
+				refreshed++
+				continue
+			}
+
+			h.dropEntry(repo, indexKey)
+			invalidated++
+		}
+	}
+
+	metrics.AptIndices.WithLabelValues(repo, "refreshed").Add(float64(refreshed))
+	metrics.AptIndices.WithLabelValues(repo, "invalidated").Add(float64(invalidated))
+	log.Printf("apt: %s lists %d files; refreshed %d and invalidated %d cached indices",
+		meta.URL, len(files), refreshed, invalidated)
+}
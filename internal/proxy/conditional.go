@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// setValidators sets the ETag and Last-Modified response headers from the
+// stored validators
+func setValidators(w http.ResponseWriter, etag, lastModified string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+}
+
+// checkPreconditions evaluates the client's conditional headers against the
+// stored validators in the order given by RFC 9110 section 13.2.2. It
+// returns true if it already answered the request with 304 or 412, in which
+// case the caller must not send a body.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag, lastModified string) bool {
+	isGetOrHead := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	// If-Match, or If-Unmodified-Since when there is no If-Match
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag, true) {
+			writePreconditionFailed(w)
+			return true
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" {
+		if modified, ok := modifiedSince(lastModified, ius); ok && modified {
+			writePreconditionFailed(w)
+			return true
+		}
+	}
+
+	// If-None-Match, or If-Modified-Since when there is no If-None-Match
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag, false) {
+			if isGetOrHead {
+				writeNotModified(w)
+			} else {
+				writePreconditionFailed(w)
+			}
+			return true
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && isGetOrHead {
+		if modified, ok := modifiedSince(lastModified, ims); ok && !modified {
+			writeNotModified(w)
+			return true
+		}
+	}
+
+	return false
+}
+
+// etagListMatches reports whether a comma-separated If-Match/If-None-Match
+// list matches etag. "*" matches any stored representation. Strong
+// comparison is used for If-Match, weak comparison for If-None-Match.
+func etagListMatches(list, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong {
+			if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince reports whether lastModified is later than the HTTP date in
+// since. ok is false if either date is missing or unparseable, in which
+// case the condition must be ignored.
+func modifiedSince(lastModified, since string) (modified, ok bool) {
+	modTime, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false, false
+	}
+	sinceTime, err := http.ParseTime(since)
+	if err != nil {
+		return false, false
+	}
+	return modTime.Truncate(time.Second).After(sinceTime), true
+}
+
+// writeNotModified sends 304, dropping the headers that describe a body
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Range")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func writePreconditionFailed(w http.ResponseWriter) {
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusPreconditionFailed)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// variantEncodings are the content codings a cache entry may be keyed by,
+// in order of preference when the client accepts several equally
+var variantEncodings = []string{"zstd", "br", "gzip"}
+
+// acceptedEncodings parses Accept-Encoding into coding -> qvalue
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		if name, val, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+				q = v
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// acceptsEncoding reports whether the client accepts coding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	if q, ok := accepted[coding]; ok {
+		return q > 0
+	}
+	return accepted["*"] > 0
+}
+
+// requestEncoding returns the Accept-Encoding sent upstream for a request,
+// which is also the variant its cache entry is keyed by. In identity mode
+// it is always "identity"; in vary mode it is the client's preferred coding
+// among variantEncodings, or "identity" if it accepts none of them.
+func (h *Handler) requestEncoding(r *http.Request) string {
+	if h.config.Cache.Encoding == "identity" {
+		return "identity"
+	}
+
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	best, bestQ := "identity", 0.0
+	for _, coding := range variantEncodings {
+		q, ok := accepted[coding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// setEncodingHeaders replays the stored Content-Encoding and Vary headers
+func setEncodingHeaders(w http.ResponseWriter, contentEncoding, vary string) {
+	if contentEncoding != "" {
+		w.Header().Set("Content-Encoding", contentEncoding)
+	}
+	if vary != "" {
+		w.Header().Set("Vary", vary)
+	}
+}
+
+// compressibleType reports whether a content type benefits from gzip;
+// packages and archives are already compressed
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+xml"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/pgp-signature":
+		return true
+	}
+	return false
+}
+
+// compressOnTheFly reports whether an identity entry should be gzipped for
+// this client. It also adds Vary for compressible types in identity mode so
+// shared caches downstream keep the two representations apart.
+func (h *Handler) compressOnTheFly(w http.ResponseWriter, r *http.Request, contentType, contentEncoding string) bool {
+	if h.config.Cache.Encoding != "identity" || contentEncoding != "" || !compressibleType(contentType) {
+		return false
+	}
+
+	if !strings.Contains(strings.ToLower(strings.Join(w.Header().Values("Vary"), ",")), "accept-encoding") {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	return acceptsEncoding(r, "gzip")
+}
+
+// serveGzip sends src gzip-compressed with a 200. The length is unknown up
+// front and the ETag is weakened since the bytes differ from the stored ones.
+func serveGzip(w http.ResponseWriter, r *http.Request, src io.Reader) error {
+	w.Header().Del("Content-Length")
+	w.Header().Del("Accept-Ranges")
+	w.Header().Set("Content-Encoding", "gzip")
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+	"repoxy/internal/rpm"
+)
+
+// startFill fetches an object from upstream as the leader of dl. If the
+// response is a cacheable 200, it starts filling dl in the background and
+// returns filling == true; the response body then belongs to the fill and
+// must not be read. Otherwise dl is aborted and the response is returned
+// for the caller to pass through.
+func (h *Handler) startFill(dl *cache.Download, repo, key, rest, query string, policy *config.PolicyConfig,
+	upstreamURL string, upstream config.UpstreamConfig, header http.Header) (*http.Response, bool, error) {
+
+	// Fetch, failing over between mirrors
+	resp, _, err := h.fetchUpstream(h.fillClient, "GET", repo, upstream, rest, query, header)
+	if err != nil {
+		dl.Abort(err)
+		return nil, false, err
+	}
+
+	return resp, h.beginFill(resp, dl, repo, key, rest, query, policy, upstreamURL, upstream, header), nil
+}
+
+// beginFill starts filling dl from an upstream response in the background
+// and reports whether it did. Responses that are not cacheable 200s the
+// policy wants stored abort dl and are left to the caller.
+func (h *Handler) beginFill(resp *http.Response, dl *cache.Download, repo, key, rest, query string,
+	policy *config.PolicyConfig, upstreamURL string, upstream config.UpstreamConfig, header http.Header) bool {
+
+	// Policies scoped to content types apply from here on. The fill stores
+	// the GET representation, so it is matched as a GET.
+	if p := h.config.MatchPolicy(config.PolicyMatch{
+		Upstream:    repo,
+		Method:      http.MethodGet,
+		Path:        rest,
+		Query:       query,
+		ContentType: resp.Header.Get("Content-Type"),
+	}); p != nil {
+		policy = p
+	}
+
+	// Only cache successful, cacheable responses the policy wants stored
+	if !h.isCacheable(resp) || resp.StatusCode != http.StatusOK || !policy.Stores(resp.ContentLength) {
+		dl.Abort(errNotCacheable)
+		return false
+	}
+
+	// Create metadata
+	meta := &cache.Metadata{
+		URL:          upstreamURL,
+		Size:         0, // Will be set on commit
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Policy:       policy.Name,
+		CreatedAt:    time.Now(),
+		LastAccess:   time.Now(),
+		Hits:         1,
+		ContentType:  resp.Header.Get("Content-Type"),
+
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		Vary:            resp.Header.Get("Vary"),
+	}
+	setFreshness(meta, resp.Header, policy, meta.CreatedAt)
+
+	// Open the temp file; from here on other requests for the key stream it
+	if err := dl.Begin(meta, resp.ContentLength); err != nil {
+		log.Printf("proxy: cache write error: %v", err)
+		return false
+	}
+
+	// The upstream transfer runs independently of any client so that it
+	// completes into the cache even if the client disconnects
+	go h.fill(resp, dl, repo, key, rest, query, upstream, header, meta)
+
+	return true
+}
+
+// proxyRange answers a range request on a miss by forwarding it upstream,
+// without touching the cache
+func (h *Handler) proxyRange(w http.ResponseWriter, r *http.Request, repo, rest string,
+	policy *config.PolicyConfig, upstream config.UpstreamConfig) error {
+
+	header := h.upstreamRequestHeader(r)
+	header.Set("Range", r.Header.Get("Range"))
+	if val := r.Header.Get("If-Range"); val != "" {
+		header.Set("If-Range", val)
+	}
+
+	resp, _, err := h.fetchUpstream(h.client, "GET", repo, upstream, rest, r.URL.RawQuery, header)
+	if err != nil {
+		http.Error(w, "upstream error", upstreamErrorStatus(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	h.copyHeaders(w, resp)
+	w.Header().Set("X-Cache", "MISS")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	h.index.IncrementStat("misses", 1)
+	return nil
+}
+
+// bypass passes a request straight through to upstream without looking up
+// or storing anything in the cache
+func (h *Handler) bypass(w http.ResponseWriter, r *http.Request, repo, rest string,
+	policy *config.PolicyConfig, upstream config.UpstreamConfig) error {
+
+	header := h.upstreamRequestHeader(r)
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if val := r.Header.Get(name); val != "" {
+			header.Set(name, val)
+		}
+	}
+
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+
+	resp, _, err := h.fetchUpstream(h.client, method, repo, upstream, rest, r.URL.RawQuery, header)
+	if err != nil {
+		http.Error(w, "upstream error", upstreamErrorStatus(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	h.copyHeaders(w, resp)
+	w.Header().Set("X-Cache", "BYPASS")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.WriteHeader(resp.StatusCode)
+	if method != http.MethodHead {
+		io.Copy(w, resp.Body)
+	}
+
+	metrics.CacheBypasses.Inc()
+	h.index.IncrementStat("misses", 1)
+	return nil
+}
+
+// fill copies an upstream response body into the download and commits it.
+// It runs detached from the client that started it. If the upstream
+// connection drops mid-body, the transfer is resumed with a Range request
+// and the rest is appended to the partial file.
+func (h *Handler) fill(resp *http.Response, dl *cache.Download, repo, key, rest, query string,
+	upstream config.UpstreamConfig, header http.Header, meta *cache.Metadata) {
+
+	body := io.ReadCloser(resp.Body)
+	retries := 0
+
+	for {
+		resumable, err := copyToDownload(dl, body, h.config.Cache.FillIdleTimeout)
+		body.Close()
+		if err == nil {
+			break
+		}
+
+		body = nil
+		if resumable {
+			log.Printf("proxy: transfer of %s interrupted at %d bytes (%v), resuming", meta.URL, dl.Written(), err)
+			for body == nil && retries < h.config.Cache.ResumeRetries {
+				retries++
+				time.Sleep(time.Duration(retries) * time.Second)
+
+				if body, err = h.resumeFill(dl, repo, rest, query, upstream, header, meta); err != nil {
+					log.Printf("proxy: resume %d of %s failed: %v", retries, meta.URL, err)
+					metrics.UpstreamResumes.WithLabelValues(repo, "failure").Inc()
+				} else {
+					// The next interruption gets a fresh set of retries
+					retries = 0
+					metrics.UpstreamResumes.WithLabelValues(repo, "success").Inc()
+				}
+			}
+		}
+
+		if body == nil {
+			if errors.Is(err, cache.ErrAbandoned) {
+				log.Printf("proxy: %s abandoned by all clients, aborting fill", meta.URL)
+			} else if !h.rejected(repo, rest, meta.URL, upstream, err) {
+				log.Printf("proxy: fill error for %s: %v", meta.URL, err)
+			}
+			// Drop the partial entry
+			dl.Abort(err)
+			return
+		}
+	}
+
+	if err := dl.Commit(); err != nil {
+		if !h.rejected(repo, rest, meta.URL, upstream, err) {
+			log.Printf("proxy: cache write error: %v", err)
+		}
+		return
+	}
+
+	// Only update index if everything succeeded
+	h.updateCacheIndex(repo, key, meta)
+	h.index.DeleteNegative(repo, key)
+
+	// Create symlink (best effort)
+	cache.CreateSymlink(h.config.Cache.Dir, repo, rest, key)
+
+	if upstream.Type == "apt" {
+		h.aptFilled(repo, key, rest, upstream, meta)
+	}
+	if (upstream.Type == "rpm" || upstream.Type == "zypper") && rpm.IsRepomd(rest) {
+		h.refreshRepomd(repo, key, rest, upstream)
+	}
+	if upstream.Type != "" {
+		h.learnChecksums(repo, key, rest, upstream)
+	}
+}
+
+// copyToDownload copies body into dl. Read errors from the upstream are
+// reported as resumable; write errors (disk, abandoned download) are not.
+// An upstream that sends nothing for idle is cut off, which counts as a
+// read error.
+func copyToDownload(dl *cache.Download, body io.ReadCloser, idle time.Duration) (resumable bool, err error) {
+	var stalled atomic.Bool
+	timer := time.AfterFunc(idle, func() {
+		stalled.Store(true)
+		body.Close()
+	})
+	defer timer.Stop()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		timer.Stop()
+		if n > 0 {
+			if _, err := dl.Write(buf[:n]); err != nil {
+				return false, err
+			}
+		}
+		if readErr == io.EOF {
+			return false, nil
+		}
+		if readErr != nil {
+			if stalled.Load() {
+				readErr = fmt.Errorf("no data from upstream for %s", idle)
+			}
+			return true, readErr
+		}
+		timer.Reset(idle)
+	}
+}
+
+// resumeFill requests the rest of an interrupted transfer. If-Range makes
+// upstream send the full object instead if it changed; in that case (or if
+// the mirror ignores Range) the body is only usable when its validators
+// still match, after skipping the bytes already on disk.
+func (h *Handler) resumeFill(dl *cache.Download, repo, rest, query string,
+	upstream config.UpstreamConfig, header http.Header, meta *cache.Metadata) (io.ReadCloser, error) {
+
+	// If-Range needs a strong validator
+	validator := meta.ETag
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = meta.LastModified
+	}
+	if validator == "" {
+		return nil, fmt.Errorf("no validator to resume with")
+	}
+
+	offset := dl.Written()
+
+	rangeHeader := header.Clone()
+	rangeHeader.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	rangeHeader.Set("If-Range", validator)
+
+	resp, _, err := h.fetchUpstream(h.fillClient, "GET", repo, upstream, rest, query, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset || (dl.ExpectedSize() >= 0 && total >= 0 && total != dl.ExpectedSize()) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		return resp.Body, nil
+
+	case http.StatusOK:
+		if resp.Header.Get("ETag") != meta.ETag || resp.Header.Get("Last-Modified") != meta.LastModified {
+			resp.Body.Close()
+			return nil, fmt.Errorf("object changed upstream")
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+}
+
+// parseContentRange parses "bytes start-end/total"; total is -1 for "*"
+func parseContentRange(s string) (start, total int64, err error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid content range")
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+
+	slash := strings.IndexByte(s, '/')
+	dash := strings.IndexByte(s, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, fmt.Errorf("invalid content range")
+	}
+
+	start, err = strconv.ParseInt(s[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total = -1
+	if s[slash+1:] != "*" {
+		total, err = strconv.ParseInt(s[slash+1:], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+)
+
+// ServeForward handles requests on forward-proxy listeners, where clients
+// configured with Acquire::http::Proxy or yum's proxy= send absolute-form
+// URIs (GET http://archive.ubuntu.com/ubuntu/... HTTP/1.1). The target is
+// mapped onto a configured upstream through forward_proxy.allowed_hosts and
+// cached in the same store as reverse-proxy requests.
+func (h *Handler) ServeForward(w http.ResponseWriter, r *http.Request) {
+	// HTTPS tunnels can't be cached, and would let clients reach any host
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT method not supported - only plain HTTP requests are proxied", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "forward proxy requests need an absolute http:// URI", http.StatusBadRequest)
+		return
+	}
+
+	repo, upstream, rest := h.config.MatchForward(r.URL.Host, r.URL.Path)
+	if upstream == nil {
+		log.Printf("proxy: refused forward request for %s%s", r.URL.Host, r.URL.Path)
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+
+	h.serve(w, r, repo, upstream, rest)
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+)
+
+// cacheControl holds the response Cache-Control directives the proxy acts on
+type cacheControl struct {
+	maxAge         time.Duration
+	sMaxAge        time.Duration
+	hasMaxAge      bool
+	hasSMaxAge     bool
+	noStore        bool
+	noCache        bool
+	private        bool
+	mustRevalidate bool
+	immutable      bool
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	var cc cacheControl
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			arg = strings.Trim(arg, `"`)
+
+			switch strings.ToLower(name) {
+			case "max-age":
+				if secs, err := strconv.ParseInt(arg, 10, 64); err == nil && secs >= 0 {
+					cc.maxAge, cc.hasMaxAge = time.Duration(secs)*time.Second, true
+				}
+			case "s-maxage":
+				if secs, err := strconv.ParseInt(arg, 10, 64); err == nil && secs >= 0 {
+					cc.sMaxAge, cc.hasSMaxAge = time.Duration(secs)*time.Second, true
+				}
+			case "no-store":
+				cc.noStore = true
+			case "no-cache":
+				cc.noCache = true
+			case "private":
+				cc.private = true
+			case "must-revalidate", "proxy-revalidate":
+				cc.mustRevalidate = true
+			case "immutable":
+				cc.immutable = true
+			}
+		}
+	}
+
+	return cc
+}
+
+// upstreamLifetime returns the freshness lifetime upstream assigned to a
+// response, as a shared cache sees it: s-maxage, then max-age, then Expires
+// relative to Date. ok is false if upstream did not say.
+func upstreamLifetime(header http.Header, cc cacheControl, now time.Time) (time.Duration, bool) {
+	switch {
+	case cc.noCache:
+		return 0, true
+	case cc.hasSMaxAge:
+		return cc.sMaxAge, true
+	case cc.hasMaxAge:
+		return cc.maxAge, true
+	}
+
+	expires := header.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		// Invalid dates such as "0" mean already expired
+		return 0, true
+	}
+
+	date := now
+	if d, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = d
+	}
+	if lifetime := expiresAt.Sub(date); lifetime > 0 {
+		return lifetime, true
+	}
+	return 0, true
+}
+
+// setFreshness computes the entry's expiry from the upstream response
+// headers according to the policy's freshness mode
+func setFreshness(meta *cache.Metadata, header http.Header, policy *config.PolicyConfig, now time.Time) {
+	ttl := policy.CacheTTL
+	meta.MustRevalidate = false
+
+	if policy.Freshness != "policy" {
+		cc := parseCacheControl(header)
+
+		if lifetime, ok := upstreamLifetime(header, cc, now); ok {
+			// Immutable responses never change, so the policy TTL may extend them
+			if cc.immutable && lifetime < policy.CacheTTL {
+				lifetime = policy.CacheTTL
+			}
+
+			// Time already spent in upstream caches counts against the lifetime
+			if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+				lifetime -= time.Duration(age) * time.Second
+			}
+			ttl = lifetime
+		}
+
+		if policy.Freshness == "clamp" {
+			if ttl < policy.MinTTL {
+				ttl = policy.MinTTL
+			}
+			if policy.MaxTTL > 0 && ttl > policy.MaxTTL {
+				ttl = policy.MaxTTL
+			}
+		}
+
+		meta.MustRevalidate = cc.mustRevalidate || cc.noCache
+	}
+
+	if ttl < 0 {
+		ttl = 0
+	}
+	meta.ExpiresAt = now.Add(ttl)
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,25 +12,54 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"repoxy/internal/apt"
 	"repoxy/internal/cache"
 	"repoxy/internal/config"
+	"repoxy/internal/health"
+	"repoxy/internal/rpm"
+	"repoxy/internal/signature"
 	"repoxy/internal/storage"
 
 	"golang.org/x/net/proxy"
 )
 
+var (
+	// errNotCacheable aborts a download whose upstream response is not cached
+	errNotCacheable = errors.New("response not cacheable")
+	// errAlreadyCached aborts a download for a key that was cached meanwhile
+	errAlreadyCached = errors.New("already cached")
+)
+
 // Handler is the main reverse proxy handler
 type Handler struct {
 	config *config.Config
 	store  *cache.Store
 	index  *storage.Index
+	health *health.Tracker
 	client *http.Client
+
+	// Like client, but without an overall timeout for fills, which may
+	// take as long as the object needs; stalled ones hit the idle timeout
+	fillClient *http.Client
+
+	// Last metalink fetched per upstream
+	metalinkMu sync.Mutex
+	metalinks  map[string]*metalinkState
+
+	// Directories with a recorded Release file or repomd.xml, by upstream
+	releaseMu   sync.Mutex
+	releaseDirs map[string]map[string]bool
+
+	// Targets of followed redirects, by upstream and original URL
+	redirectMu sync.Mutex
+	redirects  map[string]redirectTarget
 }
 
 // New creates a new proxy handler
-func New(cfg *config.Config, store *cache.Store, index *storage.Index) *Handler {
+func New(cfg *config.Config, store *cache.Store, index *storage.Index, tracker *health.Tracker) *Handler {
 	// Custom transport with reasonable timeouts
 	transport := &http.Transport{
 		DialContext: (&net.Dialer{
@@ -53,21 +83,37 @@ func New(cfg *config.Config, store *cache.Store, index *storage.Index) *Handler
 		}
 	}
 
+	// Don't follow redirects; upstreams with redirects.mode "follow" do so
+	// in sendUpstream
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
 	return &Handler{
-		config: cfg,
-		store:  store,
-		index:  index,
+		config:      cfg,
+		store:       store,
+		index:       index,
+		health:      tracker,
+		metalinks:   make(map[string]*metalinkState),
+		redirects:   make(map[string]redirectTarget),
+		releaseDirs: make(map[string]map[string]bool),
 		client: &http.Client{
-			Timeout:   5 * time.Minute, // Overall request timeout
-			Transport: transport,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// Don't follow redirects
-				return http.ErrUseLastResponse
-			},
+			Timeout:       5 * time.Minute, // Overall request timeout
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
+		},
+		fillClient: &http.Client{
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
 		},
 	}
 }
 
+// Client returns the HTTP client used for upstream requests
+func (h *Handler) Client() *http.Client {
+	return h.client
+}
+
 // configureEgressProxy sets up the HTTP transport to use an egress proxy
 func configureEgressProxy(transport *http.Transport, proxyCfg *config.ProxyConfig) error {
 	proxyURL, err := url.Parse(proxyCfg.URL)
@@ -119,14 +165,29 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Match upstream by path prefix
-	repo, upstream, rest := h.config.MatchUpstream(r.URL.Path)
+	// Dynamic HTTPS upstreams (/HTTPS///host/...) first, then match by Host
+	// header and longest path prefix
+	repo, upstream, rest := h.config.MatchDynamic(r.URL.Path)
+	if upstream == nil && h.config.Dynamic.Enabled && strings.HasPrefix(r.URL.Path, h.config.Dynamic.PathPrefix) {
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	if upstream == nil {
+		repo, upstream, rest = h.config.MatchUpstream(r.Host, r.URL.Path)
+	}
 	if upstream == nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Build upstream URL
+	h.serve(w, r, repo, upstream, rest)
+}
+
+// serve answers a request for rest below the matched upstream from the
+// cache, an in-flight download or the upstream
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, repo string, upstream *config.UpstreamConfig, rest string) {
+	// Build canonical upstream URL; the cache key is derived from base_url
+	// so it stays the same whichever mirror serves the bytes
 	upstreamURL, err := h.buildUpstreamURL(upstream.BaseURL, rest, r.URL.RawQuery)
 	if err != nil {
 		log.Printf("proxy: failed to build URL: %v", err)
@@ -134,16 +195,59 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Match policy
-	policy := h.config.MatchPolicy(rest)
+	// Match policy; policies scoped to content types are applied once the
+	// response or the cached metadata is known
+	policy := h.config.MatchPolicy(config.PolicyMatch{
+		Upstream: repo,
+		Method:   r.Method,
+		Path:     rest,
+		Query:    r.URL.RawQuery,
+	})
 	if policy == nil {
 		log.Printf("proxy: no policy matched for %s", rest)
 		http.Error(w, "no policy matched", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate cache key
-	cacheKey := cache.CacheKey(upstreamURL)
+	if policy.Action == "bypass" {
+		if err := h.bypass(w, r, repo, rest, policy, *upstream); err != nil {
+			log.Printf("proxy: bypass fetch error: %v", err)
+		}
+		return
+	}
+
+	// Generate cache key; each negotiated content coding is its own entry
+	cacheKey := cache.VariantKey(upstreamURL, h.requestEncoding(r))
+
+	// APT by-hash files and the indices they back are content-addressed,
+	// packages listed in a cached index have a known checksum and signed
+	// metadata is checked against trusted keys. Their bytes must match, so
+	// they are fetched without a content coding.
+	var expect cache.Checksum
+	contentAddressed := false
+	switch upstream.Type {
+	case "apt":
+		cacheKey, expect.SHA256 = h.aptKey(repo, rest, cacheKey)
+		contentAddressed = expect.SHA256 != ""
+		if !contentAddressed {
+			expect = h.indexChecksum(repo, rest, cache.VariantKey(upstreamURL, "identity"))
+		}
+	case "rpm", "zypper":
+		expect = h.repomdChecksum(repo, rest, cache.VariantKey(upstreamURL, "identity"))
+	}
+	if upstream.Type != "" && !contentAddressed {
+		if expect == (cache.Checksum{}) {
+			expect = h.packageChecksum(repo, rest)
+		}
+		if expect != (cache.Checksum{}) || checkedMetadata(rest, *upstream) {
+			cacheKey = cache.VariantKey(upstreamURL, "identity")
+		}
+	}
+	verify := h.metadataVerifier(repo, rest, *upstream)
+	if expect != (cache.Checksum{}) || verify != nil {
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept-Encoding", "identity")
+	}
 
 	// Check if range request
 	rangeHeader := r.Header.Get("Range")
@@ -157,31 +261,97 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Cache miss - acquire lock for request coalescing
-	lock, err := h.store.AcquireLock(cacheKey)
-	if err != nil {
-		log.Printf("proxy: lock timeout for %s", cacheKey)
-		http.Error(w, "lock timeout", http.StatusServiceUnavailable)
+	// Remembered error responses (404 for a missing InRelease, ...)
+	if h.serveNegative(w, r, repo, cacheKey, policy) {
 		return
 	}
-	// Only release if we actually acquired it
-	if lock != nil {
-		defer h.store.ReleaseLock(cacheKey)
-	}
 
-	// Double-check cache after acquiring lock
-	if h.store.Exists(repo, cacheKey) {
-		if err := h.serveFromCache(w, r, repo, cacheKey, rest, policy, upstreamURL, *upstream, rangeHeader); err != nil {
-			log.Printf("proxy: cache serve error: %v", err)
-			http.Error(w, "cache error", http.StatusInternalServerError)
+	// A HEAD miss is answered from an in-flight download of the object, or
+	// forwarded upstream unless the policy opts into filling
+	if r.Method == http.MethodHead && !policy.FillOnHead {
+		if dl := h.store.InFlight(repo, cacheKey); dl != nil && h.headDownload(w, r, dl, policy) {
+			return
+		}
+		if err := h.proxyHead(w, r, repo, rest, policy, *upstream); err != nil {
+			log.Printf("proxy: head fetch error: %v", err)
 		}
 		return
 	}
 
-	// Fetch from upstream
-	if err := h.fetchAndCache(w, r, repo, cacheKey, rest, policy, upstreamURL, *upstream); err != nil {
-		log.Printf("proxy: fetch error: %v", err)
-		// Error response already sent by fetchAndCache
+	// Cache miss - join or start the in-flight download for request coalescing
+	for {
+		dl, leader := h.store.StartDownload(repo, cacheKey)
+
+		if leader {
+			dl.Expect(expect)
+			dl.Verify(verify)
+
+			// Double-check cache now that we own the download
+			if h.store.Exists(repo, cacheKey) {
+				dl.Abort(errAlreadyCached)
+				if err := h.serveFromCache(w, r, repo, cacheKey, rest, policy, upstreamURL, *upstream, rangeHeader); err != nil {
+					log.Printf("proxy: cache serve error: %v", err)
+					http.Error(w, "cache error", http.StatusInternalServerError)
+				}
+				return
+			}
+
+			// In proxy mode a range is answered straight from upstream while
+			// the full object fills in the background
+			if rangeHeader != "" && policy.RangeOnMiss == "proxy" {
+				header, query := h.upstreamRequestHeader(r), r.URL.RawQuery
+				go func() {
+					resp, filling, err := h.startFill(dl, repo, cacheKey, rest, query, policy, upstreamURL, *upstream, header)
+					if err == nil && !filling {
+						resp.Body.Close()
+					}
+				}()
+				if err := h.proxyRange(w, r, repo, rest, policy, *upstream); err != nil {
+					log.Printf("proxy: range fetch error: %v", err)
+				}
+				return
+			}
+
+			// Fetch from upstream
+			if err := h.fetchAndCache(w, r, repo, cacheKey, rest, policy, upstreamURL, *upstream, dl, rangeHeader); err != nil {
+				log.Printf("proxy: fetch error: %v", err)
+				// Error response already sent by fetchAndCache
+			}
+			return
+		}
+
+		// Don't wait for a background fill to reach the requested bytes
+		if rangeHeader != "" && policy.RangeOnMiss == "proxy" && !rangeAvailable(dl, rangeHeader) {
+			if err := h.proxyRange(w, r, repo, rest, policy, *upstream); err != nil {
+				log.Printf("proxy: range fetch error: %v", err)
+			}
+			return
+		}
+
+		served, err := h.serveDownload(w, r, dl, policy, rangeHeader, "INFLIGHT")
+		if served {
+			return
+		}
+		if errors.Is(err, cache.ErrDownloadTimeout) {
+			log.Printf("proxy: lock timeout for %s", cacheKey)
+			http.Error(w, "lock timeout", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, signature.ErrBadSignature) {
+			http.Error(w, "upstream signature verification failed", http.StatusBadGateway)
+			return
+		}
+
+		// The leader failed before producing a cacheable response (upstream
+		// error, 404, ...); it may have been cached since, otherwise retry
+		// as leader
+		if h.store.Exists(repo, cacheKey) {
+			if err := h.serveFromCache(w, r, repo, cacheKey, rest, policy, upstreamURL, *upstream, rangeHeader); err != nil {
+				log.Printf("proxy: cache serve error: %v", err)
+				http.Error(w, "cache error", http.StatusInternalServerError)
+			}
+			return
+		}
 	}
 }
 
@@ -207,13 +377,15 @@ func (h *Handler) updateCacheIndex(repo, key string, meta *cache.Metadata) {
 		Size:       meta.Size,
 		LastAccess: meta.LastAccess,
 		Hits:       meta.Hits,
+		SHA256:     meta.SHA256,
+		Shared:     meta.Shared,
 	})
 }
 
 // applyUpstreamHeaders sets Host header and custom headers for upstream request
-func (h *Handler) applyUpstreamHeaders(req *http.Request, upstream config.UpstreamConfig) {
-	// Set host header from base_url hostname
-	if parsedURL, err := url.Parse(upstream.BaseURL); err == nil && parsedURL.Host != "" {
+func (h *Handler) applyUpstreamHeaders(req *http.Request, mirror string, upstream config.UpstreamConfig) {
+	// Set host header from the mirror's hostname
+	if parsedURL, err := url.Parse(mirror); err == nil && parsedURL.Host != "" {
 		req.Host = parsedURL.Host
 	}
 
@@ -227,25 +399,80 @@ func (h *Handler) serveFromCache(w http.ResponseWriter, r *http.Request,
 	repo, key, rest string, policy *config.PolicyConfig,
 	upstreamURL string, upstream config.UpstreamConfig, rangeHeader string) error {
 
-	f, meta, err := h.store.Get(repo, key)
+	meta, err := h.store.GetMetadata(repo, key)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	// Update access stats
-	meta.UpdateAccess()
-	h.store.UpdateMetadata(repo, key, meta)
+	// A policy scoped to the cached content type takes over
+	if p := h.config.MatchPolicy(config.PolicyMatch{
+		Upstream:    repo,
+		Method:      r.Method,
+		Path:        rest,
+		Query:       r.URL.RawQuery,
+		ContentType: meta.ContentType,
+	}); p != nil {
+		policy = p
+	}
+
+	encoding := h.requestEncoding(r)
+
+	// Content-addressed entries never change and are never revalidated
+	cacheStatus := "FRESH"
+	if meta.IsStale(policy.CacheTTL) && !meta.ContentAddressed(key) {
+		cacheStatus = "STALE"
+
+		if r.Method == http.MethodHead || (policy.AllowStaleWhileRevalidate && !meta.MustRevalidate) {
+			// Serve stale and revalidate in background. HEAD never waits
+			// for a revalidation, which may download the whole object.
+			go h.revalidate(repo, key, rest, r.URL.RawQuery, encoding, policy, upstreamURL, upstream)
+		} else {
+			dl, err := h.revalidate(repo, key, rest, r.URL.RawQuery, encoding, policy, upstreamURL, upstream)
+			if dl != nil {
+				// A changed object streams to the client while it fills
+				var served bool
+				if served, err = h.serveDownload(w, r, dl, policy, rangeHeader, "REVALIDATED"); served {
+					return nil
+				}
+			}
+
+			if err == nil {
+				cacheStatus = "REVALIDATED"
+			} else {
+				// Upstream failed - fall back to the stale copy if allowed.
+				// The last verified copy of signed metadata always stays in
+				// service.
+				if errors.Is(err, signature.ErrBadSignature) {
+					log.Printf("proxy: serving last verified %s: %v", upstreamURL, err)
+				} else if !meta.CanServeStale(policy.CacheTTL, policy.StaleIfError) {
+					http.Error(w, "upstream error", upstreamErrorStatus(err))
+					return nil
+				} else {
+					log.Printf("proxy: serving stale %s after upstream error: %v", upstreamURL, err)
+				}
+				cacheStatus = "STALE-ERROR"
+			}
+		}
+	}
 
-	// Update index
-	h.updateCacheIndex(repo, key, meta)
+	// HEAD is answered from the metadata alone, without opening the blob
+	var f *os.File
+	if r.Method == http.MethodHead {
+		if meta, err = h.store.GetMetadata(repo, key); err != nil {
+			return err
+		}
+	} else {
+		if f, meta, err = h.store.Get(repo, key); err != nil {
+			return err
+		}
+		defer f.Close()
 
-	// Check if stale
-	isStale := meta.IsStale(policy.CacheTTL)
+		// Update access stats
+		meta.UpdateAccess()
+		h.store.UpdateMetadata(repo, key, meta)
 
-	// If stale and revalidation enabled, revalidate in background
-	if isStale && policy.AllowStaleWhileRevalidate {
-		go h.revalidate(repo, key, policy, upstreamURL, upstream, meta)
+		// Update index
+		h.updateCacheIndex(repo, key, meta)
 	}
 
 	// Serve content
@@ -254,201 +481,399 @@ func (h *Handler) serveFromCache(w http.ResponseWriter, r *http.Request,
 	}
 	w.Header().Set("X-Cache", "HIT")
 	w.Header().Set("X-Cache-Policy", policy.Name)
-	if isStale {
-		w.Header().Set("X-Cache-Status", "STALE")
-	} else {
-		w.Header().Set("X-Cache-Status", "FRESH")
+	w.Header().Set("X-Cache-Status", cacheStatus)
+	w.Header().Set("Accept-Ranges", "bytes")
+	setValidators(w, meta.ETag, meta.LastModified)
+	setEncodingHeaders(w, meta.ContentEncoding, meta.Vary)
+
+	// Answer client revalidation without a body
+	if checkPreconditions(w, r, meta.ETag, meta.LastModified) {
+		h.index.IncrementStat("hits", 1)
+		return nil
+	}
+
+	if h.compressOnTheFly(w, r, meta.ContentType, meta.ContentEncoding) {
+		if err := serveGzip(w, r, f); err != nil {
+			log.Printf("proxy: gzip stream error: %v", err)
+		}
+		h.index.IncrementStat("hits", 1)
+		return nil
 	}
 
 	// Handle range requests
-	if rangeHeader != "" {
-		h.serveRange(w, r, f, meta.Size, rangeHeader)
+	if rangeHeader != "" && ifRangeMatches(r, meta.ETag, meta.LastModified) &&
+		h.serveRange(w, r, f, meta.Size, rangeHeader, meta.ContentType) {
+		h.index.IncrementStat("hits", 1)
 		return nil
 	}
 
 	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
 	w.WriteHeader(http.StatusOK)
-	io.Copy(w, f)
+	if f != nil {
+		io.Copy(w, f)
+	}
 
 	h.index.IncrementStat("hits", 1)
 	return nil
 }
 
-func (h *Handler) fetchAndCache(w http.ResponseWriter, r *http.Request,
-	repo, key, rest string, policy *config.PolicyConfig,
-	upstreamURL string, upstream config.UpstreamConfig) error {
+// serveDownload serves a request from a download another request is still
+// writing, labelled with cacheStatus. It returns false if the download failed
+// before any response was sent, in which case the caller may retry.
+func (h *Handler) serveDownload(w http.ResponseWriter, r *http.Request, dl *cache.Download,
+	policy *config.PolicyConfig, rangeHeader, cacheStatus string) (bool, error) {
 
-	// Create upstream request
-	req, err := http.NewRequest("GET", upstreamURL, nil)
+	meta, err := dl.Wait(h.config.Cache.LockTimeout, r.Context().Done())
 	if err != nil {
-		return err
+		return false, err
+	}
+	if err := dl.Verified(); err != nil {
+		return false, err
 	}
 
-	// Apply upstream headers (host + custom headers)
-	h.applyUpstreamHeaders(req, upstream)
+	reader, err := dl.NewReader()
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
 
-	// Copy relevant headers from client (but not Range for initial fetch)
-	for _, hdr := range []string{"User-Agent", "Accept", "Accept-Encoding"} {
-		if val := r.Header.Get(hdr); val != "" {
-			req.Header.Set(hdr, val)
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.Header().Set("X-Cache-Status", cacheStatus)
+	w.Header().Set("Accept-Ranges", "bytes")
+	setValidators(w, meta.ETag, meta.LastModified)
+	setEncodingHeaders(w, meta.ContentEncoding, meta.Vary)
+
+	if checkPreconditions(w, r, meta.ETag, meta.LastModified) {
+		h.index.IncrementStat("hits", 1)
+		return true, nil
+	}
+
+	if h.compressOnTheFly(w, r, meta.ContentType, meta.ContentEncoding) {
+		if err := serveGzip(w, r, reader); err != nil {
+			log.Printf("proxy: gzip stream error: %v", err)
+			abortOnMismatch(err)
 		}
+		h.index.IncrementStat("hits", 1)
+		return true, nil
 	}
 
-	// Fetch
-	resp, err := h.client.Do(req)
+	// Handle range requests as soon as the total size is known; the
+	// reader blocks until the requested bytes are on disk
+	if rangeHeader != "" && ifRangeMatches(r, meta.ETag, meta.LastModified) {
+		size, err := dl.Size()
+		if err != nil {
+			return false, err
+		}
+		if h.serveRange(w, r, reader, size, rangeHeader, meta.ContentType) {
+			h.index.IncrementStat("hits", 1)
+			return true, nil
+		}
+	}
+
+	if size := dl.ExpectedSize(); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		if _, err := io.Copy(w, reader); err != nil {
+			log.Printf("proxy: in-flight stream error: %v", err)
+			abortOnMismatch(err)
+		}
+	}
+
+	h.index.IncrementStat("hits", 1)
+	return true, nil
+}
+
+// fetchAndCache fetches from upstream as the leader of dl. Cacheable 200
+// responses are filled into the download in the background and streamed to
+// the client from it; anything else aborts the download and is passed through.
+func (h *Handler) fetchAndCache(w http.ResponseWriter, r *http.Request,
+	repo, key, rest string, policy *config.PolicyConfig,
+	upstreamURL string, upstream config.UpstreamConfig, dl *cache.Download, rangeHeader string) error {
+
+	resp, filling, err := h.startFill(dl, repo, key, rest, r.URL.RawQuery, policy,
+		upstreamURL, upstream, h.upstreamRequestHeader(r))
 	if err != nil {
-		http.Error(w, "upstream error", http.StatusBadGateway)
+		http.Error(w, "upstream error", upstreamErrorStatus(err))
 		return err
 	}
-	defer resp.Body.Close()
 
-	// Check if cacheable
-	if !h.isCacheable(resp) {
+	if !filling {
+		defer resp.Body.Close()
+
 		// Stream through without caching
 		h.copyHeaders(w, resp)
-		w.Header().Set("X-Cache", "BYPASS")
+		cacheable := h.isCacheable(resp)
+		if cacheable {
+			w.Header().Set("X-Cache", "MISS")
+		} else {
+			w.Header().Set("X-Cache", "BYPASS")
+		}
+		body := io.Reader(resp.Body)
+		if cacheable && policy.CachesNegative(resp.StatusCode) {
+			body = h.cacheNegative(resp, repo, key, upstreamURL, policy)
+		}
+
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		if r.Method != http.MethodHead {
+			io.Copy(w, body)
+		}
 		h.index.IncrementStat("misses", 1)
 		return nil
 	}
 
-	// Only cache successful responses
-	if resp.StatusCode != http.StatusOK {
-		h.copyHeaders(w, resp)
-		w.Header().Set("X-Cache", "MISS")
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-		h.index.IncrementStat("misses", 1)
-		return nil
+	// Register as a reader before applying the policy's orphan limit so the
+	// download is never considered abandoned while this client is attached
+	reader, err := dl.NewReader()
+	if err != nil {
+		http.Error(w, "cache error", http.StatusInternalServerError)
+		return err
 	}
+	defer reader.Close()
 
-	// Create metadata
-	meta := &cache.Metadata{
-		URL:          upstreamURL,
-		Size:         0, // Will be set by store.Put
-		ETag:         resp.Header.Get("ETag"),
-		LastModified: resp.Header.Get("Last-Modified"),
-		Policy:       policy.Name,
-		CreatedAt:    time.Now(),
-		LastAccess:   time.Now(),
-		Hits:         1,
-		ContentType:  resp.Header.Get("Content-Type"),
-	}
-
-	// Use TeeReader to copy to both cache and response
-	pr, pw := io.Pipe()
-	tee := io.TeeReader(resp.Body, pw)
-
-	// Write to cache in background
-	errCh := make(chan error, 1)
-	go func() {
-		if err := h.store.Put(repo, key, pr, meta); err != nil {
-			errCh <- err
-			return
-		}
-		errCh <- nil
-	}()
+	// Signed metadata is only handed out once it verified
+	if err := dl.Verified(); err != nil {
+		http.Error(w, "upstream signature verification failed", http.StatusBadGateway)
+		return err
+	}
+
+	// A HEAD that opted into filling leaves right away and the fill always
+	// completes
+	if r.Method != http.MethodHead {
+		dl.SetOrphanLimit(policy.DisconnectFillLimit())
+	}
 
-	// Stream response
+	// Stream response from the download like any coalesced request
 	h.copyHeaders(w, resp)
 	w.Header().Set("X-Cache", "MISS")
 	w.Header().Set("X-Cache-Policy", policy.Name)
-	w.WriteHeader(http.StatusOK)
-	_, copyErr := io.Copy(w, tee)
+	w.Header().Set("Accept-Ranges", "bytes")
 
-	// Close pipe writer to signal EOF to the cache goroutine
-	pw.Close()
+	if checkPreconditions(w, r, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")) {
+		h.index.IncrementStat("misses", 1)
+		return nil
+	}
 
-	// Wait for cache write
-	cacheErr := <-errCh
+	if h.compressOnTheFly(w, r, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding")) {
+		if err := serveGzip(w, r, reader); err != nil {
+			log.Printf("proxy: gzip stream error: %v", err)
+			abortOnMismatch(err)
+		}
+		h.index.IncrementStat("misses", 1)
+		return nil
+	}
 
-	// If either operation failed, clean up
-	if copyErr != nil || cacheErr != nil {
-		if copyErr != nil {
-			log.Printf("proxy: stream error: %v", copyErr)
+	if rangeHeader != "" && ifRangeMatches(r, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")) {
+		size, err := dl.Size()
+		if err != nil {
+			http.Error(w, "upstream error", http.StatusBadGateway)
+			return err
 		}
-		if cacheErr != nil {
-			log.Printf("proxy: cache write error: %v", cacheErr)
+		if h.serveRange(w, r, reader, size, rangeHeader, resp.Header.Get("Content-Type")) {
+			h.index.IncrementStat("misses", 1)
+			return nil
 		}
-		// Delete partial/corrupted cache entry
-		h.store.Delete(repo, key)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
 		h.index.IncrementStat("misses", 1)
-		return fmt.Errorf("failed to cache: copy=%v, cache=%v", copyErr, cacheErr)
+		return nil
 	}
+	_, copyErr := io.Copy(w, reader)
 
-	// Only update index if everything succeeded
-	h.updateCacheIndex(repo, key, meta)
+	h.index.IncrementStat("misses", 1)
 
-	// Create symlink (best effort)
-	cache.CreateSymlink(h.config.Cache.Dir, repo, rest, key)
+	if copyErr != nil {
+		log.Printf("proxy: stream error: %v", copyErr)
+		abortOnMismatch(copyErr)
+		return fmt.Errorf("failed to stream: %w", copyErr)
+	}
 
-	h.index.IncrementStat("misses", 1)
 	return nil
 }
 
-func (h *Handler) revalidate(repo, key string, policy *config.PolicyConfig,
-	upstreamURL string, upstream config.UpstreamConfig, meta *cache.Metadata) {
+// abortOnMismatch resets the client connection when a stream failed because
+// the content did not match its checksum, so that the client cannot take a
+// response without a Content-Length for complete
+func abortOnMismatch(err error) {
+	if errors.Is(err, cache.ErrChecksumMismatch) {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// headDownload answers a HEAD from the metadata of a download that has
+// started writing, without waiting for it. It returns false if the download
+// has no response headers yet.
+func (h *Handler) headDownload(w http.ResponseWriter, r *http.Request, dl *cache.Download,
+	policy *config.PolicyConfig) bool {
+
+	meta := dl.Meta()
+	if meta == nil {
+		return false
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.Header().Set("X-Cache-Status", "INFLIGHT")
+	w.Header().Set("Accept-Ranges", "bytes")
+	setValidators(w, meta.ETag, meta.LastModified)
+	setEncodingHeaders(w, meta.ContentEncoding, meta.Vary)
+
+	if !checkPreconditions(w, r, meta.ETag, meta.LastModified) {
+		if size := dl.ExpectedSize(); size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	h.index.IncrementStat("hits", 1)
+	return true
+}
+
+// proxyHead answers a HEAD miss by forwarding it upstream, without
+// touching the cache
+func (h *Handler) proxyHead(w http.ResponseWriter, r *http.Request, repo, rest string,
+	policy *config.PolicyConfig, upstream config.UpstreamConfig) error {
 
-	req, err := http.NewRequest("GET", upstreamURL, nil)
+	resp, _, err := h.fetchUpstream(h.client, http.MethodHead, repo, upstream, rest, r.URL.RawQuery, h.upstreamRequestHeader(r))
 	if err != nil {
-		log.Printf("revalidate: failed to create request: %v", err)
-		return
+		http.Error(w, "upstream error", upstreamErrorStatus(err))
+		return err
 	}
+	resp.Body.Close()
 
-	// Apply upstream headers (host + custom headers)
-	h.applyUpstreamHeaders(req, upstream)
+	h.copyHeaders(w, resp)
+	w.Header().Set("X-Cache", "MISS")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.WriteHeader(resp.StatusCode)
+
+	h.index.IncrementStat("misses", 1)
+	return nil
+}
 
-	// Set conditional headers
+// upstreamRequestHeader copies the client headers forwarded upstream (but
+// not Range, the cache always fetches whole objects). Accept-Encoding is
+// replaced by the single coding the cache entry is keyed by.
+func (h *Handler) upstreamRequestHeader(r *http.Request) http.Header {
+	header := make(http.Header)
+	for _, hdr := range []string{"User-Agent", "Accept"} {
+		if val := r.Header.Get(hdr); val != "" {
+			header.Set(hdr, val)
+		}
+	}
+	header.Set("Accept-Encoding", h.requestEncoding(r))
+	return header
+}
+
+// revalidate refreshes a stale cache entry with a conditional upstream
+// request. Concurrent revalidations of the same key are coalesced; the entry
+// is only refetched if it is still stale once the lock is held. A changed
+// object is filled into the cache like a miss and the download returned, so
+// that callers can stream it instead of waiting for the whole body. Network
+// errors, 5xx responses and new copies the policy does not store are
+// returned so callers can decide whether to fall back to the stale copy.
+func (h *Handler) revalidate(repo, key, rest, query, encoding string, policy *config.PolicyConfig,
+	upstreamURL string, upstream config.UpstreamConfig) (*cache.Download, error) {
+
+	if _, err := h.store.AcquireLock(key); err != nil {
+		return nil, fmt.Errorf("revalidate: %w", err)
+	}
+	defer h.store.ReleaseLock(key)
+
+	meta, err := h.store.GetMetadata(repo, key)
+	if err != nil {
+		return nil, fmt.Errorf("revalidate: failed to load metadata: %w", err)
+	}
+	if !meta.IsStale(policy.CacheTTL) {
+		// Refreshed by another request while we waited
+		return nil, nil
+	}
+
+	// Set conditional headers; a fill started from the response resumes
+	// with the plain ones
+	header := make(http.Header)
+	header.Set("Accept-Encoding", encoding)
+	conditional := header.Clone()
 	if h.config.Cache.RevalidateETag && meta.ETag != "" {
-		req.Header.Set("If-None-Match", meta.ETag)
+		conditional.Set("If-None-Match", meta.ETag)
 	}
 	if h.config.Cache.RevalidateLastMod && meta.LastModified != "" {
-		req.Header.Set("If-Modified-Since", meta.LastModified)
+		conditional.Set("If-Modified-Since", meta.LastModified)
 	}
 
-	resp, err := h.client.Do(req)
+	resp, _, err := h.fetchUpstream(h.fillClient, "GET", repo, upstream, rest, query, conditional)
 	if err != nil {
 		log.Printf("revalidate: request failed: %v", err)
-		return
+		return nil, err
+	}
+
+	// Anything but a new copy or a confirmation of the cached one is an
+	// upstream error, so the stale copy is only served if policy allows
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		log.Printf("revalidate: %s returned %d", upstreamURL, resp.StatusCode)
+		return nil, &statusError{status: resp.StatusCode}
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
 		// Still fresh - update metadata
 		meta.CreatedAt = time.Now()
+		setFreshness(meta, resp.Header, policy, meta.CreatedAt)
 		h.store.UpdateMetadata(repo, key, meta)
 		log.Printf("revalidate: %s still fresh", upstreamURL)
-		return
-	}
 
-	if resp.StatusCode == http.StatusOK {
-		// Content changed - re-cache
-		newMeta := &cache.Metadata{
-			URL:          upstreamURL,
-			ETag:         resp.Header.Get("ETag"),
-			LastModified: resp.Header.Get("Last-Modified"),
-			Policy:       policy.Name,
-			CreatedAt:    time.Now(),
-			LastAccess:   time.Now(),
-			Hits:         meta.Hits,
-			ContentType:  resp.Header.Get("Content-Type"),
+		// The indices a Release file or repomd.xml lists are refreshed
+		// along with it
+		if upstream.Type == "apt" && apt.IsReleaseFile(rest) {
+			h.refreshRelease(repo, key, rest, upstream)
+		}
+		if (upstream.Type == "rpm" || upstream.Type == "zypper") && rpm.IsRepomd(rest) {
+			h.refreshRepomd(repo, key, rest, upstream)
 		}
+		return nil, nil
+	}
 
-		if err := h.store.Put(repo, key, resp.Body, newMeta); err != nil {
-			log.Printf("revalidate: failed to update cache: %v", err)
-			return
+	// Content changed - re-cache it through a download, or join the one
+	// already filling the key
+	dl, leader := h.store.StartDownload(repo, key)
+	if !leader {
+		resp.Body.Close()
+		return dl, nil
+	}
+
+	if upstream.Type != "" && resp.Header.Get("Content-Encoding") == "" {
+		expect := h.listedChecksum(repo, rest)
+		if expect == (cache.Checksum{}) {
+			expect = h.packageChecksum(repo, rest)
 		}
+		dl.Expect(expect)
+	}
+	dl.Verify(h.metadataVerifier(repo, rest, upstream))
 
-		h.updateCacheIndex(repo, key, newMeta)
-		log.Printf("revalidate: %s updated", upstreamURL)
+	if !h.beginFill(resp, dl, repo, key, rest, query, policy, upstreamURL, upstream, header) {
+		resp.Body.Close()
+		log.Printf("revalidate: %s changed but the new copy is not cached", upstreamURL)
+		return nil, fmt.Errorf("revalidate: %s changed: %w", upstreamURL, errNotCacheable)
 	}
+	log.Printf("revalidate: %s changed, refilling", upstreamURL)
+	return dl, nil
 }
 
 func (h *Handler) isCacheable(resp *http.Response) bool {
 	// Check Cache-Control
-	cc := resp.Header.Get("Cache-Control")
-	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+	cc := parseCacheControl(resp.Header)
+	if cc.noStore || cc.private {
 		return false
 	}
 
@@ -466,99 +891,3 @@ func (h *Handler) copyHeaders(w http.ResponseWriter, resp *http.Response) {
 		}
 	}
 }
-
-func (h *Handler) serveRange(w http.ResponseWriter, r *http.Request, f *os.File, totalSize int64, rangeHeader string) {
-	// Parse range header
-	ranges, err := parseRange(rangeHeader, totalSize)
-	if err != nil || len(ranges) != 1 {
-		// Invalid range or multiple ranges not supported
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
-		return
-	}
-
-	rng := ranges[0]
-
-	// Seek and serve
-	if _, err := f.Seek(rng.start, 0); err != nil {
-		http.Error(w, "seek error", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end, totalSize))
-	w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
-	w.WriteHeader(http.StatusPartialContent)
-
-	io.CopyN(w, f, rng.length)
-}
-
-type rangeSpec struct {
-	start  int64
-	end    int64
-	length int64
-}
-
-func parseRange(s string, size int64) ([]rangeSpec, error) {
-	if !strings.HasPrefix(s, "bytes=") {
-		return nil, fmt.Errorf("invalid range header")
-	}
-
-	s = strings.TrimPrefix(s, "bytes=")
-	parts := strings.Split(s, ",")
-
-	var ranges []rangeSpec
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "-") {
-			// Suffix range
-			suffix, err := strconv.ParseInt(part[1:], 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			if suffix > size {
-				suffix = size
-			}
-			ranges = append(ranges, rangeSpec{
-				start:  size - suffix,
-				end:    size - 1,
-				length: suffix,
-			})
-		} else {
-			pos := strings.Split(part, "-")
-			if len(pos) != 2 {
-				return nil, fmt.Errorf("invalid range")
-			}
-
-			start, err := strconv.ParseInt(pos[0], 10, 64)
-			if err != nil {
-				return nil, err
-			}
-
-			var end int64
-			if pos[1] == "" {
-				end = size - 1
-			} else {
-				end, err = strconv.ParseInt(pos[1], 10, 64)
-				if err != nil {
-					return nil, err
-				}
-			}
-
-			if start > end || start >= size {
-				return nil, fmt.Errorf("invalid range")
-			}
-
-			if end >= size {
-				end = size - 1
-			}
-
-			ranges = append(ranges, rangeSpec{
-				start:  start,
-				end:    end,
-				length: end - start + 1,
-			})
-		}
-	}
-
-	return ranges, nil
-}
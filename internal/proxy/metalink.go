@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+	"repoxy/internal/rpm"
+)
+
+const (
+	// maxMetalinkMirrors bounds how many metalink mirrors are tried
+	maxMetalinkMirrors = 5
+	// maxMetalinkSize bounds metalink documents read from upstream
+	maxMetalinkSize = 4 << 20
+)
+
+// metalinkState is the last metalink fetched for an upstream
+type metalinkState struct {
+	metalink *rpm.Metalink
+	fetched  time.Time
+	done     chan struct{} // Closed when the refresh in progress finishes, nil if none
+}
+
+// mirrorURLs returns the mirrors to try for rest, in order. Upstreams with a
+// metalink try its mirrors before their own. A request for repomd.xml
+// refreshes a metalink older than the repomd.xml policy's TTL in the
+// background, as dnf and zypper do; only the first one is waited for.
+func (h *Handler) mirrorURLs(repo, rest string, upstream config.UpstreamConfig) []string {
+	if upstream.Metalink == "" {
+		return upstream.MirrorURLs()
+	}
+	if rpm.IsRepomd(rest) {
+		fetched, ok := h.metalinkFetched(repo)
+		if !ok {
+			<-h.refreshMetalink(repo, upstream)
+		} else if policy := h.config.MatchPolicy(config.PolicyMatch{
+			Upstream: repo,
+			Method:   http.MethodGet,
+			Path:     rest,
+		}); policy == nil || time.Since(fetched) >= policy.CacheTTL {
+			h.refreshMetalink(repo, upstream)
+		}
+	}
+
+	var mirrors []string
+	seen := make(map[string]bool)
+	if ml := h.metalinkFor(repo); ml != nil {
+		for _, mirror := range ml.Mirrors {
+			if len(mirrors) == maxMetalinkMirrors {
+				break
+			}
+			if !seen[mirror] {
+				seen[mirror] = true
+				mirrors = append(mirrors, mirror)
+			}
+		}
+	}
+	for _, mirror := range upstream.MirrorURLs() {
+		if !seen[mirror] {
+			seen[mirror] = true
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return mirrors
+}
+
+// metalinkFor returns the last metalink fetched for an upstream, or nil
+func (h *Handler) metalinkFor(repo string) *rpm.Metalink {
+	h.metalinkMu.Lock()
+	defer h.metalinkMu.Unlock()
+	if state := h.metalinks[repo]; state != nil {
+		return state.metalink
+	}
+	return nil
+}
+
+// metalinkFetched returns when an upstream's metalink was last fetched, or
+// false if it never was
+func (h *Handler) metalinkFetched(repo string) (time.Time, bool) {
+	h.metalinkMu.Lock()
+	defer h.metalinkMu.Unlock()
+	if state := h.metalinks[repo]; state != nil && state.metalink != nil {
+		return state.fetched, true
+	}
+	return time.Time{}, false
+}
+
+// refreshMetalink fetches an upstream's metalink in the background, joining
+// the refresh already in progress if there is one, and returns a channel
+// that is closed once it finishes. On failure the previous one stays in use.
+func (h *Handler) refreshMetalink(repo string, upstream config.UpstreamConfig) <-chan struct{} {
+	h.metalinkMu.Lock()
+	defer h.metalinkMu.Unlock()
+
+	state := h.metalinks[repo]
+	if state == nil {
+		state = &metalinkState{}
+		h.metalinks[repo] = state
+	}
+	if state.done != nil {
+		return state.done
+	}
+
+	done := make(chan struct{})
+	state.done = done
+	go func() {
+		ml, err := h.fetchMetalink(repo, upstream)
+		if err != nil {
+			log.Printf("rpm: failed to refresh metalink of %s: %v", repo, err)
+		}
+
+		h.metalinkMu.Lock()
+		if err == nil {
+			state.metalink, state.fetched = ml, time.Now()
+		}
+		state.done = nil
+		h.metalinkMu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetchMetalink downloads and parses an upstream's metalink
+func (h *Handler) fetchMetalink(repo string, upstream config.UpstreamConfig) (*rpm.Metalink, error) {
+	req, err := http.NewRequest(http.MethodGet, upstream.Metalink, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp, err = h.followRedirects(h.client, repo, req, resp, upstream); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return rpm.ParseMetalink(io.LimitReader(resp.Body, maxMetalinkSize))
+}
+
+// checkMetalink verifies a repomd.xml against the hashes of the upstream's
+// metalink. A repomd.xml newer than the metalink in use gets one refresh of
+// it to appear in. Without a metalink there is nothing to check against.
+func (h *Handler) checkMetalink(repo string, upstream config.UpstreamConfig, data []byte) error {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	listed := func(ml *rpm.Metalink) bool {
+		for _, file := range ml.Files {
+			if file.SHA256 == digest && (file.Size <= 0 || file.Size == int64(len(data))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ml := h.metalinkFor(repo)
+	if ml == nil || listed(ml) {
+		return nil
+	}
+	<-h.refreshMetalink(repo, upstream)
+	if ml = h.metalinkFor(repo); ml == nil || listed(ml) {
+		return nil
+	}
+	return fmt.Errorf("%w: repomd.xml sha256 %s is not listed in the metalink", cache.ErrChecksumMismatch, digest)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"repoxy/internal/config"
+	"repoxy/internal/storage"
+)
+
+// maxNegativeBody caps the error body stored with a negative entry; larger
+// responses are passed through without being remembered
+const maxNegativeBody = 64 << 10
+
+// negativeSkipHeaders are not stored with negative entries
+var negativeSkipHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Set-Cookie":        true,
+}
+
+// serveNegative answers a request from an unexpired negative entry. Expired
+// entries are dropped so the request goes upstream again.
+func (h *Handler) serveNegative(w http.ResponseWriter, r *http.Request, repo, key string,
+	policy *config.PolicyConfig) bool {
+
+	entry, err := h.index.GetNegative(repo, key)
+	if err != nil {
+		return false
+	}
+	if entry.IsExpired() {
+		h.index.DeleteNegative(repo, key)
+		return false
+	}
+
+	for name, values := range entry.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("X-Cache-Policy", policy.Name)
+	w.Header().Set("X-Cache-Status", "NEGATIVE")
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+
+	h.index.IncrementStat("hits", 1)
+	return true
+}
+
+// cacheNegative stores an error response as a negative entry and returns a
+// reader over the whole body for passing it through to the client
+func (h *Handler) cacheNegative(resp *http.Response, repo, key, upstreamURL string,
+	policy *config.PolicyConfig) io.Reader {
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNegativeBody+1))
+	if err != nil || len(body) > maxNegativeBody {
+		// Too large or unreadable - pass through whatever is left
+		return io.MultiReader(bytes.NewReader(body), resp.Body)
+	}
+
+	header := make(map[string][]string)
+	for name, values := range resp.Header {
+		if !negativeSkipHeaders[name] {
+			header[name] = values
+		}
+	}
+
+	now := time.Now()
+	entry := &storage.NegativeEntry{
+		Repo:      repo,
+		Key:       key,
+		URL:       upstreamURL,
+		Status:    resp.StatusCode,
+		Header:    header,
+		Body:      body,
+		CreatedAt: now,
+		ExpiresAt: now.Add(policy.NegativeTTL),
+	}
+	if err := h.index.PutNegative(entry); err != nil {
+		log.Printf("proxy: failed to store negative entry for %s: %v", upstreamURL, err)
+	}
+
+	return bytes.NewReader(body)
+}
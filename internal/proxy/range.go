@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"repoxy/internal/cache"
+)
+
+// maxRanges caps the number of parts in a multipart/byteranges response;
+// requests asking for more are answered with the full body
+const maxRanges = 64
+
+// errInvalidRange means the Range header could not be parsed and must be ignored
+var errInvalidRange = errors.New("invalid range header")
+
+type rangeSpec struct {
+	start  int64
+	end    int64
+	length int64
+}
+
+func (r rangeSpec) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// ifRangeMatches evaluates If-Range against the stored validators. Ranges
+// only apply if there is no If-Range or it matches: an entity tag must be a
+// strong match of the ETag, a date must equal Last-Modified exactly.
+func ifRangeMatches(r *http.Request, etag, lastModified string) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && !strings.HasPrefix(ifRange, "W/") && ifRange == etag
+	}
+
+	return lastModified != "" && ifRange == lastModified
+}
+
+// serveRange answers a Range request from f. Overlapping and adjacent
+// ranges are merged, parts past the end are dropped and multiple parts are
+// sent as multipart/byteranges. It returns false without writing anything
+// if the header should be ignored, in which case the caller sends the full
+// body. f is not read for HEAD requests and may be nil.
+func (h *Handler) serveRange(w http.ResponseWriter, r *http.Request, f io.ReadSeeker,
+	totalSize int64, rangeHeader, contentType string) bool {
+
+	ranges, err := parseRange(rangeHeader, totalSize)
+	if err != nil || len(ranges) > maxRanges {
+		return false
+	}
+
+	if len(ranges) == 0 {
+		// Nothing satisfiable
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	ranges = coalesceRanges(ranges)
+
+	if len(ranges) == 1 {
+		rng := ranges[0]
+
+		// Seek and serve
+		if r.Method != http.MethodHead {
+			if _, err := f.Seek(rng.start, io.SeekStart); err != nil {
+				http.Error(w, "seek error", http.StatusInternalServerError)
+				return true
+			}
+		}
+
+		w.Header().Set("Content-Range", rng.contentRange(totalSize))
+		w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+
+		if r.Method != http.MethodHead {
+			io.CopyN(w, f, rng.length)
+		}
+		return true
+	}
+
+	boundary := multipartBoundary()
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartSize(ranges, totalSize, contentType, boundary), 10))
+	w.Header().Del("Content-Range")
+	w.WriteHeader(http.StatusPartialContent)
+
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	for _, rng := range ranges {
+		io.WriteString(w, partHeader(rng, totalSize, contentType, boundary))
+		if _, err := f.Seek(rng.start, io.SeekStart); err != nil {
+			return true
+		}
+		if _, err := io.CopyN(w, f, rng.length); err != nil {
+			return true
+		}
+	}
+	io.WriteString(w, "\r\n--"+boundary+"--\r\n")
+
+	return true
+}
+
+// partHeader returns the delimiter and headers that precede a part
+func partHeader(rng rangeSpec, totalSize int64, contentType, boundary string) string {
+	var b strings.Builder
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	if contentType != "" {
+		b.WriteString("Content-Type: " + contentType + "\r\n")
+	}
+	b.WriteString("Content-Range: " + rng.contentRange(totalSize) + "\r\n\r\n")
+	return b.String()
+}
+
+// multipartSize computes the exact length of a multipart/byteranges body
+func multipartSize(ranges []rangeSpec, totalSize int64, contentType, boundary string) int64 {
+	var size int64
+	for _, rng := range ranges {
+		size += int64(len(partHeader(rng, totalSize, contentType, boundary))) + rng.length
+	}
+	size += int64(len("\r\n--" + boundary + "--\r\n"))
+	return size
+}
+
+func multipartBoundary() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// coalesceRanges sorts ranges and merges those that overlap or touch
+func coalesceRanges(ranges []rangeSpec) []rangeSpec {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := ranges[:1]
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng.start <= last.end+1 {
+			if rng.end > last.end {
+				last.end = rng.end
+				last.length = last.end - last.start + 1
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+
+	return merged
+}
+
+// rangeAvailable reports whether every byte requested by rangeHeader has
+// already been written to the in-flight download
+func rangeAvailable(dl *cache.Download, rangeHeader string) bool {
+	size := dl.ExpectedSize()
+	if size < 0 {
+		return false
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil || len(ranges) == 0 {
+		return false
+	}
+
+	written := dl.Written()
+	for _, rng := range ranges {
+		if rng.end >= written {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRange parses a bytes Range header against the object size. Syntax
+// errors return errInvalidRange; ranges that start past the end are
+// dropped, so an empty result means nothing is satisfiable.
+func parseRange(s string, size int64) ([]rangeSpec, error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, errInvalidRange
+	}
+
+	s = strings.TrimPrefix(s, "bytes=")
+	parts := strings.Split(s, ",")
+
+	var ranges []rangeSpec
+	var specs int
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		specs++
+
+		if strings.HasPrefix(part, "-") {
+			// Suffix range
+			suffix, err := strconv.ParseInt(part[1:], 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, errInvalidRange
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			ranges = append(ranges, rangeSpec{
+				start:  size - suffix,
+				end:    size - 1,
+				length: suffix,
+			})
+			continue
+		}
+
+		pos := strings.Split(part, "-")
+		if len(pos) != 2 {
+			return nil, errInvalidRange
+		}
+
+		start, err := strconv.ParseInt(pos[0], 10, 64)
+		if err != nil || start < 0 {
+			return nil, errInvalidRange
+		}
+
+		end := size - 1
+		if pos[1] != "" {
+			end, err = strconv.ParseInt(pos[1], 10, 64)
+			if err != nil || start > end {
+				return nil, errInvalidRange
+			}
+		}
+
+		if start >= size {
+			// Unsatisfiable, but other ranges may still be served
+			continue
+		}
+
+		if end >= size {
+			end = size - 1
+		}
+
+		ranges = append(ranges, rangeSpec{
+			start:  start,
+			end:    end,
+			length: end - start + 1,
+		})
+	}
+
+	if specs == 0 {
+		return nil, errInvalidRange
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+)
+
+const (
+	// maxRedirects bounds the redirects followed for one upstream request
+	maxRedirects = 10
+	// maxRedirectTargets bounds how many redirect targets are remembered
+	maxRedirectTargets = 10000
+)
+
+// redirectTarget is where a followed redirect led, until it expires
+type redirectTarget struct {
+	url     string
+	expires time.Time
+}
+
+// followsRedirects reports whether redirects from the upstream are followed
+// instead of being passed to the client
+func followsRedirects(upstream config.UpstreamConfig) bool {
+	return upstream.Redirects.Mode == "follow"
+}
+
+// sendUpstream sends a request to an upstream with client. For upstreams that follow
+// redirects, a remembered redirect target is tried first and redirects are
+// followed to the final response, which is then cached under the original
+// URL like any other.
+func (h *Handler) sendUpstream(client *http.Client, repo string, req *http.Request, upstream config.UpstreamConfig) (*http.Response, error) {
+	if !followsRedirects(upstream) {
+		return client.Do(req)
+	}
+	if resp := h.fetchRedirectTarget(client, repo, req, upstream); resp != nil {
+		return resp, nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return h.followRedirects(client, repo, req, resp, upstream)
+}
+
+// fetchRedirectTarget requests the remembered redirect target of req, or
+// returns nil if there is none. A target that fails or answers with an
+// error or another redirect is forgotten, so that the original URL is
+// asked again.
+func (h *Handler) fetchRedirectTarget(client *http.Client, repo string, req *http.Request, upstream config.UpstreamConfig) *http.Response {
+	key := repo + " " + req.URL.String()
+	target, ok := h.rememberedRedirect(key)
+	if !ok {
+		return nil
+	}
+
+	next, err := redirectRequest(req, req.Method, target, upstream)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = client.Do(next); err == nil {
+			if resp.StatusCode < 400 && !isRedirect(resp.StatusCode) {
+				metrics.UpstreamRedirects.WithLabelValues(repo, "remembered").Inc()
+				return resp
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+
+	log.Printf("proxy: redirect target %s of %s failed: %v", target, req.URL, err)
+	h.redirectMu.Lock()
+	delete(h.redirects, key)
+	h.redirectMu.Unlock()
+	return nil
+}
+
+// followRedirects follows redirect responses to the final response.
+// Redirects may lead to the original host and scheme, the upstream's
+// mirrors and the hosts its allowed_hosts lists; the first one that leads
+// elsewhere is returned as it is. Credentials and custom upstream headers
+// are not sent to other hosts or schemes.
+func (h *Handler) followRedirects(client *http.Client, repo string, req *http.Request, resp *http.Response, upstream config.UpstreamConfig) (*http.Response, error) {
+	orig := req
+	for hops := 0; isRedirect(resp.StatusCode); hops++ {
+		location, err := resp.Location()
+		if err != nil {
+			// Nothing to follow; hand the response on as it is
+			return resp, nil
+		}
+		sameOrigin := location.Host == orig.URL.Host && location.Scheme == orig.URL.Scheme
+		if !sameOrigin && !h.redirectAllowed(repo, location, upstream) {
+			log.Printf("proxy: not following redirect of %s to %s", orig.URL, location)
+			metrics.UpstreamRedirects.WithLabelValues(repo, "refused").Inc()
+			if hops > 0 {
+				// Relative to the hop that sent it, not the original URL
+				resp.Header.Set("Location", location.String())
+			}
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		if hops == maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		method := req.Method
+		if resp.StatusCode == http.StatusSeeOther && method != http.MethodHead {
+			method = http.MethodGet
+		}
+
+		if req, err = redirectRequest(req, method, location.String(), upstream); err != nil {
+			return nil, err
+		}
+		if resp, err = client.Do(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if req != orig {
+		metrics.UpstreamRedirects.WithLabelValues(repo, "followed").Inc()
+		if resp.StatusCode < 400 && req.Method == orig.Method {
+			h.rememberRedirect(repo+" "+orig.URL.String(), req.URL.String(), upstream.Redirects.CacheTTL)
+		}
+	}
+	return resp, nil
+}
+
+// redirectAllowed reports whether a redirect to location may be followed:
+// its host is allowed by the upstream's allowed_hosts, or its scheme and
+// host are those of one of the upstream's mirrors or a mirror of its
+// metalink
+func (h *Handler) redirectAllowed(repo string, location *url.URL, upstream config.UpstreamConfig) bool {
+	if upstream.Redirects.AllowsHost(location.Host) {
+		return true
+	}
+
+	mirrors := upstream.MirrorURLs()
+	if upstream.Metalink != "" {
+		if ml := h.metalinkFor(repo); ml != nil {
+			mirrors = append(mirrors, ml.Mirrors...)
+		}
+	}
+	for _, mirror := range mirrors {
+		u, err := url.Parse(mirror)
+		if err == nil && u.Scheme == location.Scheme && strings.EqualFold(u.Hostname(), location.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectRequest builds the request for a redirect of prev to location
+func redirectRequest(prev *http.Request, method, location string, upstream config.UpstreamConfig) (*http.Request, error) {
+	next, err := http.NewRequest(method, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	next.Header = prev.Header.Clone()
+	if next.URL.Host != prev.URL.Host || next.URL.Scheme != prev.URL.Scheme {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+		for key := range upstream.Headers {
+			next.Header.Del(key)
+		}
+	}
+	return next, nil
+}
+
+// rememberedRedirect returns the remembered target for key, if it has not expired
+func (h *Handler) rememberedRedirect(key string) (string, bool) {
+	h.redirectMu.Lock()
+	defer h.redirectMu.Unlock()
+
+	target, ok := h.redirects[key]
+	if !ok || time.Now().After(target.expires) {
+		return "", false
+	}
+	return target.url, true
+}
+
+// rememberRedirect records where key redirected to for ttl. Expired
+// targets are dropped once the map is full.
+func (h *Handler) rememberRedirect(key, url string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	h.redirectMu.Lock()
+	defer h.redirectMu.Unlock()
+
+	now := time.Now()
+	if _, ok := h.redirects[key]; !ok && len(h.redirects) >= maxRedirectTargets {
+		for k, target := range h.redirects {
+			if now.After(target.expires) {
+				delete(h.redirects, k)
+			}
+		}
+		if len(h.redirects) >= maxRedirectTargets {
+			return
+		}
+	}
+	h.redirects[key] = redirectTarget{url: url, expires: now.Add(ttl)}
+}
+
+// isRedirect reports whether a status code is a redirect with a Location
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+	"repoxy/internal/rpm"
+	"repoxy/internal/storage"
+)
+
+// repomdChecksum returns the size and digest the current repomd.xml lists
+// for rest, or the zero Checksum for files it does not list. A cached copy
+// under key that does not match is dropped so it is fetched again.
+func (h *Handler) repomdChecksum(repo, rest, key string) cache.Checksum {
+	_, file, ok := h.listedFile(repo, rest)
+	if !ok {
+		return cache.Checksum{}
+	}
+
+	if meta, err := h.store.GetMetadata(repo, key); err == nil && !matchesRelease(meta, file) {
+		log.Printf("rpm: cached %s does not match its repomd.xml, refetching", meta.URL)
+		h.dropEntry(repo, key)
+		metrics.RpmMetadata.WithLabelValues(repo, "invalidated").Inc()
+	}
+	return cache.Checksum{Size: file.Size, SHA256: file.SHA256}
+}
+
+// repomdOutdated runs after a file listed in a repomd.xml was rejected for
+// not matching it. Upstream has most likely published a newer repomd.xml,
+// so the cached one is expired to be revalidated next.
+func (h *Handler) repomdOutdated(repo, rest string, upstream config.UpstreamConfig) {
+	root, _, ok := h.listedFile(repo, rest)
+	if !ok {
+		return
+	}
+
+	repomdURL, err := h.buildUpstreamURL(upstream.BaseURL, root+"repodata/repomd.xml", "")
+	if err != nil {
+		return
+	}
+
+	log.Printf("rpm: %s does not match the cached repomd.xml, expiring it", rest)
+	metrics.RpmMetadata.WithLabelValues(repo, "outdated_repomd").Inc()
+
+	for _, encoding := range append([]string{"identity"}, variantEncodings...) {
+		key := cache.VariantKey(repomdURL, encoding)
+		meta, err := h.store.GetMetadata(repo, key)
+		if err != nil {
+			continue
+		}
+		meta.ExpiresAt = time.Now()
+		h.store.UpdateMetadata(repo, key, meta)
+	}
+}
+
+// refreshRepomd parses a repomd.xml that was just stored or revalidated and
+// records the files it lists. Cached copies of them are brought in line
+// with it: matching ones take over its freshness, others are dropped.
+func (h *Handler) refreshRepomd(repo, key, rest string, upstream config.UpstreamConfig) {
+	f, meta, err := h.store.Get(repo, key)
+	if err != nil {
+		log.Printf("rpm: failed to open repomd.xml: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if meta.ContentEncoding != "" {
+		return
+	}
+
+	md, err := rpm.ParseRepomd(f)
+	if err != nil {
+		log.Printf("rpm: failed to parse %s: %v", meta.URL, err)
+		return
+	}
+
+	root := rpm.Root(rest)
+	files := make(map[string]storage.ReleaseFile, len(md.Files))
+	for name, file := range md.Files {
+		files[name] = storage.ReleaseFile{Size: file.Size, SHA256: file.SHA256}
+	}
+	if err := h.putRelease(repo, root, files); err != nil {
+		log.Printf("rpm: failed to record %s: %v", meta.URL, err)
+		return
+	}
+
+	var refreshed, invalidated int
+	for name, file := range files {
+		fileURL, err := h.buildUpstreamURL(upstream.BaseURL, root+name, "")
+		if err != nil {
+			continue
+		}
+
+		for _, encoding := range append([]string{"identity"}, variantEncodings...) {
+			fileKey := cache.VariantKey(fileURL, encoding)
+			fileMeta, err := h.store.GetMetadata(repo, fileKey)
+			if err != nil {
+				continue
+			}
+
+			if matchesRelease(fileMeta, &file) {
+				fileMeta.CreatedAt = meta.CreatedAt
+				fileMeta.ExpiresAt = meta.ExpiresAt
+				h.store.UpdateMetadata(repo, fileKey, fileMeta)
+				refreshed++
+				continue
+			}
+
+			h.dropEntry(repo, fileKey)
+			invalidated++
+		}
+	}
+
+	metrics.RpmMetadata.WithLabelValues(repo, "refreshed").Add(float64(refreshed))
+	metrics.RpmMetadata.WithLabelValues(repo, "invalidated").Add(float64(invalidated))
+	log.Printf("rpm: %s (revision %s) lists %d files; refreshed %d and invalidated %d cached files",
+		meta.URL, md.Revision, len(files), refreshed, invalidated)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+	"repoxy/internal/signature"
+)
+
+// maxSignatureSize bounds detached signature files read from upstream
+const maxSignatureSize = 1 << 20
+
+// checkSignature verifies metadata against the upstream's trusted keys if
+// rest is signed metadata; other files pass. Detached signatures are
+// fetched from upstream.
+func (h *Handler) checkSignature(repo, rest string, data []byte, upstream config.UpstreamConfig) error {
+	if upstream.Keyring == nil {
+		return nil
+	}
+	scheme, sigPath, ok := signature.For(upstream.Type, rest)
+	if !ok {
+		return nil
+	}
+
+	var sig []byte
+	var err error
+	if scheme == signature.Detached {
+		if sig, err = h.fetchSignature(repo, sigPath, upstream); err != nil {
+			return fmt.Errorf("%w: %s: %v", signature.ErrBadSignature, sigPath, err)
+		}
+	}
+
+	// Failures are counted by rejected once the download is aborted
+	if err := upstream.Keyring.Verify(scheme, data, sig); err != nil {
+		return err
+	}
+	metrics.SignatureChecks.WithLabelValues(repo, "valid").Inc()
+	metrics.SignatureAlert.WithLabelValues(repo).Set(0)
+	return nil
+}
+
+// fetchSignature downloads a detached signature file
+func (h *Handler) fetchSignature(repo, sigPath string, upstream config.UpstreamConfig) ([]byte, error) {
+	header := make(http.Header)
+	header.Set("Accept-Encoding", "identity")
+
+	resp, _, err := h.fetchUpstream(h.client, "GET", repo, upstream, sigPath, "", header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"repoxy/internal/config"
+	"repoxy/internal/health"
+	"repoxy/internal/metrics"
+)
+
+// fetchUpstream sends a request for rest with client to each mirror of the
+// upstream in order, skipping mirrors whose circuit is open. Connection errors, timeouts
+// and 5xx responses are recorded against the mirror and move on to the next
+// one; the first other response is returned along with the mirror that
+// served it. If every mirror answers 5xx, the last response is returned so
+// the client still sees the upstream status.
+func (h *Handler) fetchUpstream(client *http.Client, method, repo string, upstream config.UpstreamConfig,
+	rest, query string, header http.Header) (*http.Response, string, error) {
+
+	var lastErr error
+	var lastResp *http.Response
+	var lastMirror string
+	allowed := false
+
+	for _, mirror := range h.mirrorURLs(repo, rest, upstream) {
+		mirrorURL, err := h.buildUpstreamURL(mirror, rest, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		req, err := http.NewRequest(method, mirrorURL, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		// Apply upstream headers (host + custom headers)
+		h.applyUpstreamHeaders(req, mirror, upstream)
+
+		// Only ask just before contacting the mirror: a half-open mirror
+		// hands out its one trial here, which must be reported back
+		if !h.health.Allow(repo, mirror) {
+			continue
+		}
+		allowed = true
+
+		start := time.Now()
+		resp, err := h.sendUpstream(client, repo, req, upstream)
+		if err != nil {
+			log.Printf("proxy: mirror %s failed: %v", mirror, err)
+			h.health.RecordFailure(repo, mirror, err)
+			lastErr = err
+			continue
+		}
+		metrics.UpstreamDuration.WithLabelValues(repo).Observe(time.Since(start).Seconds())
+
+		if lastResp != nil {
+			io.Copy(io.Discard, io.LimitReader(lastResp.Body, 4096))
+			lastResp.Body.Close()
+			lastResp = nil
+		}
+
+		if resp.StatusCode >= 500 {
+			log.Printf("proxy: mirror %s returned %d", mirror, resp.StatusCode)
+			h.health.RecordFailure(repo, mirror, fmt.Errorf("upstream status %d", resp.StatusCode))
+			// Kept in case no later mirror answers
+			lastResp, lastMirror = resp, mirror
+			continue
+		}
+
+		h.health.RecordSuccess(repo, mirror, time.Since(start))
+		return resp, mirror, nil
+	}
+
+	if lastResp != nil {
+		return lastResp, lastMirror, nil
+	}
+	if !allowed && lastErr == nil {
+		return nil, "", fmt.Errorf("upstream %s: %w", repo, health.ErrCircuitOpen)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no mirrors configured")
+	}
+	return nil, "", fmt.Errorf("all mirrors failed: %w", lastErr)
+}
+
+// statusError is an upstream response that could not be used
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("upstream status %d", e.status)
+}
+
+// upstreamErrorStatus maps a fetchUpstream error to the status sent to the
+// client. Client errors of the upstream are passed on as they are.
+func upstreamErrorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) && se.status >= 400 && se.status < 500 {
+		return se.status
+	}
+	if errors.Is(err, health.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"repoxy/internal/apt"
+	"repoxy/internal/cache"
+	"repoxy/internal/config"
+	"repoxy/internal/metrics"
+	"repoxy/internal/rpm"
+	"repoxy/internal/signature"
+	"repoxy/internal/storage"
+	"repoxy/internal/verify"
+)
+
+// packageChecksum returns the size and digest a cached index lists for rest,
+// or the zero Checksum if none does
+func (h *Handler) packageChecksum(repo, rest string) cache.Checksum {
+	sum, err := h.index.GetChecksum(repo, rest)
+	if err != nil {
+		return cache.Checksum{}
+	}
+	return cache.Checksum{Size: sum.Size, SHA256: sum.SHA256}
+}
+
+// indexPath returns the path an index was stored under by name: by-hash
+// files of an APT upstream resolve to the index their Release file lists
+// with that digest
+func (h *Handler) indexPath(repo, rest string, upstream config.UpstreamConfig) string {
+	digest := apt.ByHashDigest(rest)
+	if upstream.Type != "apt" || digest == "" {
+		return rest
+	}
+
+	dir := strings.TrimSuffix(rest, "by-hash/SHA256/"+digest)
+	for _, name := range []string{"Packages", "Packages.gz", "Packages.xz", "Packages.bz2", "Packages.zst"} {
+		if _, file, ok := h.listedFile(repo, dir+name); ok && file.SHA256 == digest {
+			return dir + name
+		}
+	}
+	return rest
+}
+
+// learnChecksums records the package checksums listed in a package index
+// that was just stored, so that later downloads of those packages are
+// verified. Other objects are ignored.
+func (h *Handler) learnChecksums(repo, key, rest string, upstream config.UpstreamConfig) {
+	rest = h.indexPath(repo, rest, upstream)
+	format, base, ok := verify.DetectIndex(upstream.Type, rest)
+	if !ok {
+		return
+	}
+
+	f, meta, err := h.store.Get(repo, key)
+	if err != nil {
+		log.Printf("verify: failed to open index: %v", err)
+		return
+	}
+	defer f.Close()
+
+	// Indices are compressed files; a transfer coding on top is not undone
+	if meta.ContentEncoding != "" {
+		return
+	}
+
+	pkgs, err := verify.Parse(format, f)
+	if err != nil {
+		log.Printf("verify: failed to parse %s: %v", meta.URL, err)
+		return
+	}
+
+	sums := make(map[string]storage.Checksum, len(pkgs))
+	for _, pkg := range pkgs {
+		name := strings.TrimPrefix(path.Join(base, pkg.Path), "/")
+		sums[name] = storage.Checksum{Size: pkg.Size, SHA256: pkg.SHA256}
+	}
+	if err := h.index.PutChecksums(repo, sums); err != nil {
+		log.Printf("verify: failed to record checksums of %s: %v", meta.URL, err)
+		return
+	}
+	log.Printf("verify: %s lists %d packages", meta.URL, len(sums))
+}
+
+// checkedMetadata reports whether rest is metadata whose content is checked
+// before it is cached: signed metadata of an upstream with trusted keys and
+// the repomd.xml of an upstream with a metalink
+func checkedMetadata(rest string, upstream config.UpstreamConfig) bool {
+	if upstream.Metalink != "" && rpm.IsRepomd(rest) {
+		return true
+	}
+	if upstream.Keyring == nil {
+		return false
+	}
+	_, _, ok := signature.For(upstream.Type, rest)
+	return ok
+}
+
+// metadataVerifier returns a Verifier that only lets checked metadata into
+// the cache once it matches its metalink and signature, or nil for
+// anything else
+func (h *Handler) metadataVerifier(repo, rest string, upstream config.UpstreamConfig) cache.Verifier {
+	if !checkedMetadata(rest, upstream) {
+		return nil
+	}
+
+	return func(body io.Reader) error {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if upstream.Metalink != "" && rpm.IsRepomd(rest) {
+			if err := h.checkMetalink(repo, upstream, data); err != nil {
+				return err
+			}
+		}
+		return h.checkSignature(repo, rest, data, upstream)
+	}
+}
+
+// rejected logs and counts a download that failed because it does not
+// match its expected checksum or signature, and reports whether that was
+// the case. A bad signature raises the upstream's alert.
+func (h *Handler) rejected(repo, rest, url string, upstream config.UpstreamConfig, err error) bool {
+	switch {
+	case errors.Is(err, cache.ErrChecksumMismatch):
+		log.Printf("verify: rejected %s: %v", url, err)
+		metrics.VerifyRejections.WithLabelValues(repo).Inc()
+		switch upstream.Type {
+		case "apt":
+			h.releaseOutdated(repo, rest, upstream)
+		case "rpm", "zypper":
+			h.repomdOutdated(repo, rest, upstream)
+		}
+	case errors.Is(err, signature.ErrBadSignature):
+		log.Printf("signature: rejected %s: %v", url, err)
+		metrics.SignatureChecks.WithLabelValues(repo, "invalid").Inc()
+		metrics.SignatureAlert.WithLabelValues(repo).Set(1)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package rpm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Metalink is a parsed metalink document for a repository's repomd.xml
+type Metalink struct {
+	// Mirrors are the repository roots serving it, most preferred first
+	Mirrors []string
+	// Files are the current repomd.xml and the recent ones mirrors may
+	// still serve
+	Files []File
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkXML struct {
+	Files []struct {
+		Name       string         `xml:"name,attr"`
+		Size       int64          `xml:"size"`
+		Hashes     []metalinkHash `xml:"verification>hash"`
+		Alternates []struct {
+			Size   int64          `xml:"size"`
+			Hashes []metalinkHash `xml:"verification>hash"`
+		} `xml:"alternates>alternate"`
+		URLs []struct {
+			Preference int    `xml:"preference,attr"`
+			Value      string `xml:",chardata"`
+		} `xml:"resources>url"`
+	} `xml:"files>file"`
+}
+
+// ParseMetalink reads a metalink (version 3, as served by MirrorManager
+// and MirrorCache) and returns the mirrors and hashes of its repomd.xml
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	var doc metalinkXML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	for _, f := range doc.Files {
+		if f.Name != "repomd.xml" {
+			continue
+		}
+
+		ml := &Metalink{}
+		ml.addFile(f.Size, f.Hashes)
+		for _, alt := range f.Alternates {
+			ml.addFile(alt.Size, alt.Hashes)
+		}
+
+		urls := f.URLs
+		sort.SliceStable(urls, func(i, j int) bool { return urls[i].Preference > urls[j].Preference })
+		for _, u := range urls {
+			if mirror, ok := mirrorRoot(strings.TrimSpace(u.Value)); ok {
+				ml.Mirrors = append(ml.Mirrors, mirror)
+			}
+		}
+
+		if len(ml.Files) == 0 {
+			return nil, fmt.Errorf("no sha256 hash for repomd.xml")
+		}
+		return ml, nil
+	}
+	return nil, fmt.Errorf("no repomd.xml in metalink")
+}
+
+// addFile records a size and the sha256 among hashes, if any
+func (ml *Metalink) addFile(size int64, hashes []metalinkHash) {
+	for _, h := range hashes {
+		if h.Type == "sha256" {
+			ml.Files = append(ml.Files, File{Size: size, SHA256: strings.ToLower(strings.TrimSpace(h.Value))})
+			return
+		}
+	}
+}
+
+// mirrorRoot turns the URL of a mirror's repomd.xml into its repository
+// root. Only http and https mirrors are used.
+func mirrorRoot(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	if !strings.HasSuffix(u.Path, "/repodata/repomd.xml") {
+		return "", false
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/repodata/repomd.xml")
+	u.RawQuery, u.Fragment = "", ""
+	return u.String(), true
+}
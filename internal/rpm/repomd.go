@@ -0,0 +1,80 @@
+// Package rpm reads RPM repository metadata: repodata/repomd.xml and
+// metalink documents
+package rpm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// File is the expected size and digest of a metadata file. SHA256 is empty
+// when the listing uses another checksum type.
+type File struct {
+	Size   int64
+	SHA256 string
+}
+
+// Repomd is a parsed repomd.xml. Files are keyed by their location below
+// the repository root (the directory holding repodata/).
+type Repomd struct {
+	Revision string
+	Files    map[string]File
+}
+
+// checksumXML is a checksum element with its type attribute
+type checksumXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type repomdXML struct {
+	Revision string `xml:"revision"`
+	Data     []struct {
+		Type     string      `xml:"type,attr"`
+		Checksum checksumXML `xml:"checksum"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+		Size int64 `xml:"size"`
+	} `xml:"data"`
+}
+
+// IsRepomd reports whether rest is a repodata/repomd.xml
+func IsRepomd(rest string) bool {
+	return path.Base(rest) == "repomd.xml" && path.Base(path.Dir(rest)) == "repodata"
+}
+
+// Root returns the repository root of a path below repodata/, ending in /
+// unless it is the upstream root
+func Root(rest string) string {
+	return rest[:strings.LastIndex("/"+rest, "/repodata/")]
+}
+
+// ParseRepomd reads a repomd.xml
+func ParseRepomd(r io.Reader) (*Repomd, error) {
+	var doc repomdXML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	md := &Repomd{Revision: strings.TrimSpace(doc.Revision), Files: make(map[string]File)}
+	for _, data := range doc.Data {
+		href := path.Clean(data.Location.Href)
+		if data.Location.Href == "" || strings.HasPrefix(href, "../") || path.IsAbs(href) {
+			continue
+		}
+
+		file := File{Size: data.Size}
+		if data.Checksum.Type == "sha256" {
+			file.SHA256 = strings.ToLower(strings.TrimSpace(data.Checksum.Value))
+		}
+		md.Files[href] = file
+	}
+	if len(md.Files) == 0 {
+		return nil, fmt.Errorf("no data files listed")
+	}
+	return md, nil
+}
@@ -0,0 +1,69 @@
+// Package signature verifies the signatures of repository metadata against
+// trusted keys
+package signature
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Keyring holds the trusted keys of an upstream: OpenPGP keys for signed
+// and clearsigned metadata, RSA keys for APK indices
+type Keyring struct {
+	pgp openpgp.EntityList
+	rsa []*rsa.PublicKey
+}
+
+// LoadKeyring reads trusted keys from files. Each file holds armored or
+// binary OpenPGP public keys, or a PEM RSA public key as used by apk.
+func LoadKeyring(paths []string) (*Keyring, error) {
+	k := &Keyring{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.add(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return k, nil
+}
+
+// add parses the keys in one file
+func (k *Keyring) add(data []byte) error {
+	if block, _ := pem.Decode(data); block != nil && block.Type == "PUBLIC KEY" {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("not an RSA public key")
+		}
+		k.rsa = append(k.rsa, key)
+		return nil
+	}
+
+	var entities openpgp.EntityList
+	var err error
+	if bytes.Contains(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		return fmt.Errorf("no public keys found")
+	}
+	k.pgp = append(k.pgp, entities...)
+	return nil
+}
@@ -0,0 +1,179 @@
+package signature
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// ErrBadSignature is returned when metadata is not signed by a trusted key
+var ErrBadSignature = errors.New("bad signature")
+
+// Scheme is how a metadata file is signed
+type Scheme int
+
+const (
+	Clearsigned Scheme = iota + 1 // Signature inline (InRelease)
+	Detached                      // Signature in a separate file
+	APKIndex                      // RSA signature in the first gzip stream
+)
+
+var pacmanDB = regexp.MustCompile(`\.db(\.tar\.(gz|xz|zst))?$`)
+
+// For reports whether rest, a path below an upstream of the given type, is
+// signed metadata, and returns how it is signed and, for detached
+// signatures, the path of the signature file
+func For(upstreamType, rest string) (Scheme, string, bool) {
+	name := path.Base(rest)
+
+	switch upstreamType {
+	case "apt":
+		switch name {
+		case "InRelease":
+			return Clearsigned, "", true
+		case "Release":
+			return Detached, rest + ".gpg", true
+		}
+
+	case "rpm", "zypper":
+		if name == "repomd.xml" && path.Base(path.Dir(rest)) == "repodata" {
+			return Detached, rest + ".asc", true
+		}
+
+	case "apk":
+		if name == "APKINDEX.tar.gz" {
+			return APKIndex, "", true
+		}
+
+	case "pacman":
+		if pacmanDB.MatchString(name) {
+			return Detached, rest + ".sig", true
+		}
+	}
+	return 0, "", false
+}
+
+// Verify checks data, signed with the given scheme, against the keyring.
+// sig is the detached signature, armored or binary; it is ignored by the
+// other schemes. Failures wrap ErrBadSignature.
+func (k *Keyring) Verify(scheme Scheme, data, sig []byte) error {
+	var err error
+	switch scheme {
+	case Clearsigned:
+		err = k.verifyClearsigned(data)
+	case Detached:
+		err = k.verifyDetached(data, sig)
+	case APKIndex:
+		err = k.verifyAPKIndex(data)
+	default:
+		err = fmt.Errorf("unknown signature scheme %d", scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return nil
+}
+
+// verifyClearsigned checks an inline-signed message. Nothing but whitespace
+// may surround the signed block, so unsigned lines cannot be smuggled in.
+func (k *Keyring) verifyClearsigned(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		return fmt.Errorf("not clearsigned")
+	}
+
+	block, rest := clearsign.Decode(data)
+	if block == nil {
+		return fmt.Errorf("malformed clearsigned message")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return fmt.Errorf("trailing data after signature")
+	}
+
+	_, err := block.VerifySignature(k.pgp, nil)
+	return err
+}
+
+// verifyDetached checks data against a detached signature
+func (k *Keyring) verifyDetached(data, sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("no signature")
+	}
+
+	var err error
+	if bytes.Contains(sig, []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(k.pgp, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(k.pgp, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	}
+	return err
+}
+
+// verifyAPKIndex checks an APKINDEX.tar.gz. Its first gzip stream is a tar
+// holding .SIGN.RSA.<key> (SHA1) or .SIGN.RSA256.<key> (SHA256), a PKCS#1
+// signature over the compressed bytes of the rest of the file.
+func (k *Keyring) verifyAPKIndex(data []byte) error {
+	r := bytes.NewReader(data)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+
+	var sig []byte
+	var hash crypto.Hash
+	tr := tar.NewReader(zr)
+	for sig == nil {
+		hdr, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("no signature: %v", err)
+		}
+
+		switch {
+		case strings.HasPrefix(hdr.Name, ".SIGN.RSA256."):
+			hash = crypto.SHA256
+		case strings.HasPrefix(hdr.Name, ".SIGN.RSA."):
+			hash = crypto.SHA1
+		default:
+			continue
+		}
+		if sig, err = io.ReadAll(tr); err != nil {
+			return err
+		}
+	}
+
+	// bytes.Reader is read without buffering, so what is left once the
+	// first stream ends is exactly the signed part
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return err
+	}
+	signed := data[len(data)-r.Len():]
+
+	var digest []byte
+	if hash == crypto.SHA256 {
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	} else {
+		sum := sha1.Sum(signed)
+		digest = sum[:]
+	}
+
+	for _, key := range k.rsa {
+		if rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("not signed by a trusted key")
+}
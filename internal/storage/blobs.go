@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var blobsBucket = []byte("blobs")
+
+// BlobEntry is a content-addressed blob and the number of cache entries
+// sharing it
+type BlobEntry struct {
+	Size int64 `json:"size"`
+	Refs int64 `json:"refs"`
+}
+
+// AddBlobRef records one more entry sharing the blob with the given digest
+func (idx *Index) AddBlobRef(digest string, size int64) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blobsBucket)
+
+		var blob BlobEntry
+		if data := b.Get([]byte(digest)); data != nil {
+			if err := json.Unmarshal(data, &blob); err != nil {
+				return err
+			}
+		}
+		blob.Size = size
+		blob.Refs++
+
+		data, err := json.Marshal(blob)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(digest), data)
+	})
+}
+
+// ReleaseBlobRef drops one reference to a blob and returns how many remain.
+// The blob's entry is removed with its last reference.
+func (idx *Index) ReleaseBlobRef(digest string) (int64, error) {
+	var remaining int64
+
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blobsBucket)
+
+		data := b.Get([]byte(digest))
+		if data == nil {
+			return nil
+		}
+
+		var blob BlobEntry
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return err
+		}
+
+		blob.Refs--
+		if blob.Refs <= 0 {
+			return b.Delete([]byte(digest))
+		}
+		remaining = blob.Refs
+
+		data, err := json.Marshal(blob)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(digest), data)
+	})
+
+	return remaining, err
+}
+
+// ResetBlobRefs replaces all blob references, e.g. after a rebuild
+func (idx *Index) ResetBlobRefs(blobs map[string]BlobEntry) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(blobsBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(blobsBucket)
+		if err != nil {
+			return err
+		}
+
+		for digest, blob := range blobs {
+			data, err := json.Marshal(blob)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(digest), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var checksumsBucket = []byte("checksums")
+
+// Checksum is the size and digest a package file must have, as listed in a
+// cached repository index. SHA256 is empty for indices that only list sizes.
+type Checksum struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// PutChecksums records the checksums an index lists, keyed by path below
+// the upstream, in a single transaction. Entries from newer indices replace
+// older ones for the same path.
+func (idx *Index) PutChecksums(repo string, sums map[string]Checksum) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(checksumsBucket)
+
+		for name, sum := range sums {
+			data, err := json.Marshal(sum)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(repo+"/"+name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetChecksum returns the checksum recorded for a path below the upstream
+func (idx *Index) GetChecksum(repo, name string) (*Checksum, error) {
+	var sum Checksum
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(checksumsBucket)
+
+		data := b.Get([]byte(repo + "/" + name))
+		if data == nil {
+			return fmt.Errorf("no checksum recorded")
+		}
+
+		return json.Unmarshal(data, &sum)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sum, nil
+}
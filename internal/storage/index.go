@@ -22,6 +22,8 @@ type IndexEntry struct {
 	Size       int64     `json:"size"`
 	LastAccess time.Time `json:"last_access"`
 	Hits       int64     `json:"hits"`
+	SHA256     string    `json:"sha256,omitempty"`
+	Shared     bool      `json:"shared,omitempty"` // Shared entries with the same digest have one blob
 }
 
 // Index manages the BoltDB-based LRU index
@@ -44,6 +46,18 @@ func NewIndex(path string) (*Index, error) {
 		if _, err := tx.CreateBucketIfNotExists(statsBucket); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(negativeBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(releasesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(blobsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(checksumsBucket); err != nil {
+			return err
+		}
 		return nil
 	}); err != nil {
 		db.Close()
@@ -116,9 +130,11 @@ func (idx *Index) Delete(repo, key string) error {
 	})
 }
 
-// TotalSize calculates the total cached size
+// TotalSize calculates the total cached size, counting blobs shared by
+// several entries once
 func (idx *Index) TotalSize() (int64, error) {
 	var total int64
+	seen := make(map[string]bool)
 
 	err := idx.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(entriesBucket)
@@ -128,6 +144,12 @@ func (idx *Index) TotalSize() (int64, error) {
 			if err := json.Unmarshal(v, &entry); err != nil {
 				return nil // Skip corrupt entries
 			}
+			if entry.Shared && entry.SHA256 != "" {
+				if seen[entry.SHA256] {
+					return nil
+				}
+				seen[entry.SHA256] = true
+			}
 			total += entry.Size
 			return nil
 		})
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var negativeBucket = []byte("negative")
+
+// NegativeEntry is a cached error response (404, 410, ...) for a URL
+type NegativeEntry struct {
+	Repo      string              `json:"repo"`
+	Key       string              `json:"key"`
+	URL       string              `json:"url"`
+	Status    int                 `json:"status"`
+	Header    map[string][]string `json:"header,omitempty"`
+	Body      []byte              `json:"body,omitempty"`
+	CreatedAt time.Time           `json:"created_at"`
+	ExpiresAt time.Time           `json:"expires_at"`
+}
+
+// IsExpired checks if the negative entry has outlived its TTL
+func (e *NegativeEntry) IsExpired() bool {
+	return time.Now().After(e.ExpiresAt)
+}
+
+// PutNegative adds or replaces a negative entry
+func (idx *Index) PutNegative(entry *NegativeEntry) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(negativeBucket)
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(entry.Repo+"/"+entry.Key), data)
+	})
+}
+
+// GetNegative retrieves a negative entry, expired or not
+func (idx *Index) GetNegative(repo, key string) (*NegativeEntry, error) {
+	var entry NegativeEntry
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(negativeBucket)
+
+		data := b.Get([]byte(repo + "/" + key))
+		if data == nil {
+			return fmt.Errorf("entry not found")
+		}
+
+		return json.Unmarshal(data, &entry)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// DeleteNegative removes a negative entry
+func (idx *Index) DeleteNegative(repo, key string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(negativeBucket)
+		return b.Delete([]byte(repo + "/" + key))
+	})
+}
+
+// ListNegative returns all negative entries
+func (idx *Index) ListNegative() ([]*NegativeEntry, error) {
+	var entries []*NegativeEntry
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(negativeBucket)
+
+		return b.ForEach(func(k, v []byte) error {
+			var entry NegativeEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return nil // Skip corrupt entries
+			}
+			entries = append(entries, &entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// PruneNegative removes expired negative entries and returns how many were removed
+func (idx *Index) PruneNegative() (int, error) {
+	var pruned int
+
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(negativeBucket)
+
+		// Deleting while iterating makes the cursor skip keys, so collect
+		// the expired ones first
+		var expired [][]byte
+		now := time.Now()
+		err := b.ForEach(func(k, v []byte) error {
+			var entry NegativeEntry
+			if err := json.Unmarshal(v, &entry); err != nil || now.After(entry.ExpiresAt) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+
+	return pruned, err
+}
@@ -14,6 +14,7 @@ func (idx *Index) RebuildFromDisk(cacheDir string) error {
 	log.Println("Scanning cache directory for existing files...")
 
 	var scanned, added int
+	blobs := make(map[string]BlobEntry)
 
 	// Walk through cache directory
 	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
@@ -57,6 +58,15 @@ func (idx *Index) RebuildFromDisk(cacheDir string) error {
 			return nil
 		}
 
+		// Count references to shared blobs
+		shared := meta.SHA256 != "" && sharesBlob(cacheDir, blobPath, meta.SHA256)
+		if shared {
+			blob := blobs[meta.SHA256]
+			blob.Size = meta.Size
+			blob.Refs++
+			blobs[meta.SHA256] = blob
+		}
+
 		// Add to index
 		entry := &IndexEntry{
 			Repo:       repo,
@@ -65,6 +75,8 @@ func (idx *Index) RebuildFromDisk(cacheDir string) error {
 			Size:       meta.Size,
 			LastAccess: meta.LastAccess,
 			Hits:       meta.Hits,
+			SHA256:     meta.SHA256,
+			Shared:     shared,
 		}
 
 		if err := idx.Put(entry); err != nil {
@@ -85,6 +97,21 @@ func (idx *Index) RebuildFromDisk(cacheDir string) error {
 		return err
 	}
 
-	log.Printf("Index rebuild complete: scanned %d metadata files, added %d entries", scanned, added)
+	if err := idx.ResetBlobRefs(blobs); err != nil {
+		return err
+	}
+
+	log.Printf("Index rebuild complete: scanned %d metadata files, added %d entries, %d shared blobs", scanned, added, len(blobs))
 	return nil
 }
+
+// sharesBlob reports whether an entry blob is linked to the content-addressed
+// blob of its digest
+func sharesBlob(cacheDir, blobPath, digest string) bool {
+	blobInfo, err := os.Stat(blobPath)
+	if err != nil {
+		return false
+	}
+	casInfo, err := os.Stat(cache.CASPath(cacheDir, digest))
+	return err == nil && os.SameFile(blobInfo, casInfo)
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var releasesBucket = []byte("releases")
+
+// ReleaseFile is the expected size and digest of an index file, as listed
+// in the current APT Release file or RPM repomd.xml of its directory
+type ReleaseFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// releasePrefix is the key prefix of the files of the Release file in dir;
+// the separator keeps nested directories apart
+func releasePrefix(repo, dir string) []byte {
+	return []byte(repo + "/" + dir + "\x00")
+}
+
+// PutRelease replaces the files listed for the Release file or repomd.xml
+// in dir (a path below the upstream ending in /) in a single transaction
+func (idx *Index) PutRelease(repo, dir string, files map[string]ReleaseFile) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(releasesBucket)
+		prefix := releasePrefix(repo, dir)
+
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for name, file := range files {
+			data, err := json.Marshal(file)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(append(append([]byte{}, prefix...), name...), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetReleaseFile returns the entry for name in the Release file of dir
+func (idx *Index) GetReleaseFile(repo, dir, name string) (*ReleaseFile, error) {
+	var file ReleaseFile
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(releasesBucket)
+
+		data := b.Get(append(releasePrefix(repo, dir), name...))
+		if data == nil {
+			return fmt.Errorf("file not listed")
+		}
+
+		return json.Unmarshal(data, &file)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// ReleaseDirs returns the directories of an upstream with a recorded
+// Release file or repomd.xml
+func (idx *Index) ReleaseDirs(repo string) ([]string, error) {
+	var dirs []string
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(repo + "/")
+		c := tx.Bucket(releasesBucket).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); {
+			dir, _, _ := bytes.Cut(k[len(prefix):], []byte{0})
+			dirs = append(dirs, string(dir))
+
+			// Skip the other files listed for this directory
+			next := releasePrefix(repo, string(dir))
+			next[len(next)-1] = 1
+			k, _ = c.Seek(next)
+		}
+		return nil
+	})
+
+	return dirs, err
+}
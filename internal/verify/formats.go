@@ -0,0 +1,225 @@
+package verify
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parsePackages reads a Debian Packages file: one stanza per package with
+// Filename, Size and SHA256 fields
+func parsePackages(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	var pkg Package
+
+	flush := func() {
+		if pkg.Path != "" && pkg.Size > 0 {
+			pkgs = append(pkgs, pkg)
+		}
+		pkg = Package{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		// Continuation lines belong to multiline fields like Description
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch field {
+		case "Filename":
+			pkg.Path = value
+		case "Size":
+			pkg.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "SHA256":
+			pkg.SHA256 = strings.ToLower(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return pkgs, nil
+}
+
+// primaryPackage is the part of a primary.xml package element we need
+type primaryPackage struct {
+	Checksum struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"checksum"`
+	Size struct {
+		Package int64 `xml:"package,attr"`
+	} `xml:"size"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+}
+
+// parsePrimary reads an RPM repodata primary.xml. Only SHA256 checksums
+// are kept; packages with other checksum types are checked by size.
+func parsePrimary(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return pkgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+
+		var p primaryPackage
+		if err := decoder.DecodeElement(&p, &start); err != nil {
+			return nil, err
+		}
+		if p.Location.Href == "" || p.Size.Package <= 0 {
+			continue
+		}
+
+		pkg := Package{Path: p.Location.Href, Size: p.Size.Package}
+		if p.Checksum.Type == "sha256" {
+			pkg.SHA256 = strings.ToLower(strings.TrimSpace(p.Checksum.Value))
+		}
+		pkgs = append(pkgs, pkg)
+	}
+}
+
+// parseAPKIndex reads the APKINDEX file of an APKINDEX.tar.gz. Its C:
+// checksum covers only the control segment, so packages are checked by size.
+func parseAPKIndex(r io.Reader) ([]Package, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no APKINDEX in archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == "APKINDEX" {
+			return parseAPKRecords(tr)
+		}
+	}
+}
+
+// parseAPKRecords reads APKINDEX records of P:, V: and S: lines
+func parseAPKRecords(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+	var name, version string
+	var size int64
+
+	flush := func() {
+		if name != "" && version != "" && size > 0 {
+			pkgs = append(pkgs, Package{Path: name + "-" + version + ".apk", Size: size})
+		}
+		name, version, size = "", "", 0
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch field {
+		case "P":
+			name = value
+		case "V":
+			version = value
+		case "S":
+			size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return pkgs, nil
+}
+
+// parsePacmanDB reads the desc files of a pacman repository database
+func parsePacmanDB(r io.Reader) ([]Package, error) {
+	var pkgs []Package
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return pkgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "desc" {
+			continue
+		}
+
+		pkg, err := parsePacmanDesc(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if pkg.Path != "" && pkg.Size > 0 {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+}
+
+// parsePacmanDesc reads %FILENAME%, %CSIZE% and %SHA256SUM% from a desc
+// file, where each %SECTION% line is followed by its values
+func parsePacmanDesc(r io.Reader) (Package, error) {
+	var pkg Package
+	var section string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			section = ""
+			continue
+		}
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			section = line
+			continue
+		}
+
+		switch section {
+		case "%FILENAME%":
+			pkg.Path = line
+		case "%CSIZE%":
+			pkg.Size, _ = strconv.ParseInt(line, 10, 64)
+		case "%SHA256SUM%":
+			pkg.SHA256 = strings.ToLower(line)
+		}
+	}
+	return pkg, scanner.Err()
+}
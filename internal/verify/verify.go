@@ -0,0 +1,131 @@
+// Package verify learns the expected sizes and digests of package files
+// from repository index files
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"repoxy/internal/rpm"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Format is a package index format
+type Format string
+
+const (
+	Debian Format = "deb"    // Packages
+	RPM    Format = "rpm"    // repodata primary.xml
+	APK    Format = "apk"    // APKINDEX.tar.gz
+	Pacman Format = "pacman" // repo .db
+)
+
+// Package is a package file listed in an index. Path is relative to the
+// index's base directory; SHA256 is empty when the index only has a size.
+type Package struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+var (
+	debianIndex = regexp.MustCompile(`(^|/)Packages(\.(gz|xz|bz2|zst))?$`)
+	rpmIndex    = regexp.MustCompile(`(^|/)repodata/([0-9a-f]+-)?primary\.xml(\.(gz|xz|bz2|zst))?$`)
+	apkIndex    = regexp.MustCompile(`(^|/)APKINDEX\.tar\.gz$`)
+	pacmanIndex = regexp.MustCompile(`\.db(\.tar\.(gz|xz|zst))?$`)
+)
+
+// DetectIndex reports whether rest, a path below an upstream of the given
+// type, is a package index, and returns its format and the directory the
+// package paths it lists are relative to
+func DetectIndex(upstreamType, rest string) (Format, string, bool) {
+	dir := path.Dir(rest) + "/"
+	if dir == "./" {
+		dir = ""
+	}
+
+	switch upstreamType {
+	case "apt":
+		if !debianIndex.MatchString(rest) {
+			return "", "", false
+		}
+		// Filename is relative to the archive root above dists/; flat
+		// repositories list paths relative to the index itself
+		if i := strings.Index("/"+rest, "/dists/"); i >= 0 {
+			return Debian, rest[:i], true
+		}
+		return Debian, dir, true
+
+	case "rpm", "zypper":
+		// Locations are relative to the directory holding repodata/
+		if rpmIndex.MatchString(rest) {
+			return RPM, rpm.Root(rest), true
+		}
+
+	case "apk":
+		if apkIndex.MatchString(rest) {
+			return APK, dir, true
+		}
+
+	case "pacman":
+		if pacmanIndex.MatchString(rest) {
+			return Pacman, dir, true
+		}
+	}
+	return "", "", false
+}
+
+// Parse reads an index, compressed or not, and returns the packages it lists
+func Parse(format Format, r io.Reader) ([]Package, error) {
+	r, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	switch format {
+	case Debian:
+		return parsePackages(r)
+	case RPM:
+		return parsePrimary(r)
+	case APK:
+		return parseAPKIndex(r)
+	case Pacman:
+		return parsePacmanDB(r)
+	}
+	return nil, fmt.Errorf("unknown index format %q", format)
+}
+
+// Decompress detects gzip, xz, bzip2 or zstd compression by its magic
+// bytes and returns a reader over the uncompressed data
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		d, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return br, nil
+}